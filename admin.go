@@ -0,0 +1,259 @@
+package lulu
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/trainking/lulu/logger"
+	"github.com/trainking/lulu/session"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// adminMaxBody 管理接口请求体的最大长度
+const adminMaxBody = 1 << 20
+
+var (
+	// errAdminUserID 无效的 user_id 参数
+	errAdminUserID = errors.New("invalid user_id")
+
+	// errAdminOpCode 无效的 opcode 参数
+	errAdminOpCode = errors.New("invalid opcode")
+
+	// errAdminReason 无效的 reason 参数
+	errAdminReason = errors.New("invalid reason")
+
+	// errAdminOffline 玩家不在线
+	errAdminOffline = errors.New("user offline")
+)
+
+type (
+	// adminSession 管理接口返回的会话信息
+	adminSession struct {
+		SessionID int64  `json:"session_id"`
+		UserID    uint64 `json:"user_id"`
+		RemoteIP  string `json:"remote_ip"`
+		Detached  bool   `json:"detached"`
+	}
+)
+
+// serveAdmin 配置了 AdminAddress 时，启动管理接口的 HTTP 服务；
+// 请求需要携带 Authorization: Bearer <Password>，未配置 Password 时不启动
+func (app *App) serveAdmin() {
+	if app.Config.AdminAddress == "" {
+		return
+	}
+	if app.Config.Password == "" {
+		app.logger.Error("admin server requires Password, not started", logger.String("addr", app.Config.AdminAddress))
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", app.adminAuth(http.MethodGet, app.adminSessions))
+	mux.HandleFunc("/sessions/count", app.adminAuth(http.MethodGet, app.adminSessionCount))
+	mux.HandleFunc("/sessions/user", app.adminAuth(http.MethodGet, app.adminSessionUser))
+	mux.HandleFunc("/kick", app.adminAuth(http.MethodPost, app.adminKick))
+	mux.HandleFunc("/broadcast", app.adminAuth(http.MethodPost, app.adminBroadcast))
+	mux.HandleFunc("/routes", app.adminAuth(http.MethodGet, app.adminRoutes))
+	mux.HandleFunc("/modules", app.adminAuth(http.MethodGet, app.adminModules))
+
+	app.adminServer = &http.Server{
+		Addr:    app.Config.AdminAddress,
+		Handler: mux,
+	}
+	go func() {
+		if err := app.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			app.logger.Error("admin server failed", logger.String("addr", app.Config.AdminAddress), logger.Err(err))
+		}
+	}()
+}
+
+// adminAuth 校验请求方法和密码
+func (app *App) adminAuth(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(app.Config.Password)) != 1 {
+			adminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// adminSessions 在线会话列表
+func (app *App) adminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := app.SessionManager.Snapshot()
+	list := make([]adminSession, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, newAdminSession(s))
+	}
+	adminJSON(w, http.StatusOK, map[string]interface{}{
+		"count":    len(list),
+		"sessions": list,
+	})
+}
+
+// adminSessionCount 在线会话数量
+func (app *App) adminSessionCount(w http.ResponseWriter, r *http.Request) {
+	adminJSON(w, http.StatusOK, map[string]interface{}{
+		"count":       app.SessionManager.Len(),
+		"connections": atomic.LoadInt32(&app.connCount),
+	})
+}
+
+// adminSessionUser 通过 user_id 查询会话
+func (app *App) adminSessionUser(w http.ResponseWriter, r *http.Request) {
+	s, err := app.adminLookup(r)
+	if err != nil {
+		adminLookupError(w, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, newAdminSession(s))
+}
+
+// adminKick 踢出玩家，reason 未设置时为 KickReasonServer
+func (app *App) adminKick(w http.ResponseWriter, r *http.Request) {
+	s, err := app.adminLookup(r)
+	if err != nil {
+		adminLookupError(w, err)
+		return
+	}
+
+	reason := session.KickReasonServer
+	if v := r.URL.Query().Get("reason"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, errAdminReason)
+			return
+		}
+		reason = session.KickReason(n)
+	}
+
+	if err := s.Kick(reason, nil); err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, newAdminSession(s))
+}
+
+// adminBroadcast 将 JSON 请求体转换为 opcode 对应的返回消息，
+// 设置 user_id 时只发送给该玩家，否则发送给所有在线玩家
+func (app *App) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	opcode, err := strconv.ParseUint(r.URL.Query().Get("opcode"), 10, 16)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, errAdminOpCode)
+		return
+	}
+	_r, ok := app.RouterManager.GetSendRouter(uint16(opcode))
+	if !ok {
+		adminError(w, http.StatusNotFound, ErrNoRegister)
+		return
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(_r.Name)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, adminMaxBody))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	msg := mt.New().Interface()
+	if err := protojson.Unmarshal(body, msg); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.URL.Query().Get("user_id") != "" {
+		s, err := app.adminLookup(r)
+		if err != nil {
+			adminLookupError(w, err)
+			return
+		}
+		if err := s.Send(msg); err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		adminJSON(w, http.StatusOK, map[string]interface{}{"count": 1})
+		return
+	}
+
+	if err := app.SessionManager.BroadcastAll(msg); err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]interface{}{"count": app.SessionManager.Len()})
+}
+
+// adminRoutes 路由表
+func (app *App) adminRoutes(w http.ResponseWriter, r *http.Request) {
+	adminJSON(w, http.StatusOK, app.RouterManager.Routes())
+}
+
+// adminModules 已加载的模块
+func (app *App) adminModules(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(app.modules))
+	for _, m := range app.modules {
+		names = append(names, m.Name())
+	}
+	adminJSON(w, http.StatusOK, names)
+}
+
+// adminLookup 通过 user_id 参数查找在线会话
+func (app *App) adminLookup(r *http.Request) (*session.Session, error) {
+	userID, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil || userID == 0 {
+		return nil, errAdminUserID
+	}
+	s, ok := app.SessionManager.Get(userID)
+	if !ok {
+		return nil, errAdminOffline
+	}
+	return s, nil
+}
+
+// newAdminSession 会话信息
+func newAdminSession(s *session.Session) adminSession {
+	return adminSession{
+		SessionID: s.ID,
+		UserID:    s.GetUserID(),
+		RemoteIP:  s.RemoteIP(),
+		Detached:  s.IsDetached(),
+	}
+}
+
+// adminLookupError 查找会话失败的响应
+func adminLookupError(w http.ResponseWriter, err error) {
+	if err == errAdminOffline {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	adminError(w, http.StatusBadRequest, err)
+}
+
+// adminError 错误响应
+func adminError(w http.ResponseWriter, code int, err error) {
+	adminJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// adminJSON JSON 响应
+func adminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,98 @@
+package lulu
+
+import (
+	"github.com/pkg/errors"
+	"github.com/trainking/lulu/network"
+)
+
+type (
+	// Authenticator 身份验证接口，验证未验证会话的登录请求，返回用户 ID
+	Authenticator interface {
+		// Authenticate 验证登录请求；ctx.Message() 为登录路由注册的消息，未注册路由时使用 ctx.Bind 解码；
+		// 返回 *Error 时原样回复给客户端，其他错误回复 CodeAuthFailed；多设备登录时在此设置 Session.SetDevice
+		Authenticate(ctx Context) (uint64, error)
+	}
+
+	// AuthenticatorFunc 函数形式的身份验证
+	AuthenticatorFunc func(ctx Context) (uint64, error)
+
+	// authRejecter Authenticate 成功后登录被重复登录策略拒绝时的回调，用于回滚验证时记录的状态
+	authRejecter interface {
+		reject(ctx Context)
+	}
+)
+
+// Authenticate 验证登录请求
+func (f AuthenticatorFunc) Authenticate(ctx Context) (uint64, error) {
+	return f(ctx)
+}
+
+// SetAuthenticator 设置身份验证；设置后，未验证会话的登录请求先经过验证，成功后设置 UserID，
+// 再交给登录路由的中间件和 Handler 处理。LoginOpCode 为 0 时，未验证会话的任意请求都视为登录请求
+func (app *App) SetAuthenticator(a Authenticator) {
+	app.authenticator = a
+}
+
+// isLogin 是否为需要验证的登录请求
+func (app *App) isLogin(p network.Packet) bool {
+	if app.Config.LoginOpCode > 0 {
+		return p.OpCode() == uint16(app.Config.LoginOpCode)
+	}
+	return true
+}
+
+// loginRouter 登录请求的路由，在登录路由的中间件之前先进行身份验证；登录路由未注册时只进行验证
+func (app *App) loginRouter(opcode uint16) Router {
+	r, ok := app.RouterManager.GetHandleRouter(opcode)
+	if !ok {
+		r = Router{
+			OpCode:  opcode,
+			Kind:    RouteKindHandle,
+			Handler: func(ctx Context) error { return nil },
+		}
+	}
+
+	// 路由的中间件后注册的在外层，身份验证放在最后，在登录路由的中间件之前执行
+	m := make([]Middleware, 0, len(r.Middleware)+1)
+	m = append(m, r.Middleware...)
+	r.Middleware = append(m, app.authMiddleware())
+	return r
+}
+
+// authMiddleware 身份验证的中间件，验证成功后设置 UserID
+func (app *App) authMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx Context) error {
+			// 同一会话的其他登录请求已经验证通过
+			if ctx.Session().IsValid() {
+				return next(ctx)
+			}
+
+			// Authenticate 读取 ctx.Message()，先返回解码的错误
+			if err := loadMessage(ctx); err != nil {
+				return err
+			}
+			userID, err := app.authenticator.Authenticate(ctx)
+			if err != nil {
+				var e *Error
+				if errors.As(err, &e) {
+					return err
+				}
+				return errors.Wrapf(ErrAuthFailed, "%v", err)
+			}
+			if userID == 0 {
+				return ErrAuthFailed
+			}
+			// 重复登录策略拒绝时，会话保持未验证，可以重新登录
+			if !app.SessionManager.Admit(userID, ctx.Session().Device()) {
+				if r, ok := app.authenticator.(authRejecter); ok {
+					r.reject(ctx)
+				}
+				return ErrDuplicateLogin
+			}
+
+			ctx.Session().SetUserID(userID)
+			return next(ctx)
+		}
+	}
+}
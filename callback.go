@@ -3,6 +3,8 @@ package lulu
 import (
 	"sync/atomic"
 
+	"github.com/trainking/lulu/codec"
+	"github.com/trainking/lulu/logger"
 	"github.com/trainking/lulu/network"
 	"github.com/trainking/lulu/session"
 	"google.golang.org/protobuf/proto"
@@ -19,21 +21,78 @@ func (a *App) OnConnect(s *session.Session) {
 func (a *App) OnMessage(s *session.Session, p network.Packet) {
 	// 消息洪水检查
 	if s.CheckFlood(a.Config.HeartLimit) {
-		s.Destroy()
+		p.Free()
+		a.metrics.floodKicks.Inc()
+		s.Kick(session.KickReasonFlood, nil)
+		return
+	}
+
+	// 客户端协商压缩算法，未配置压缩时不占用 CompressOpCode
+	if a.Config.Compressor != "" && p.OpCode() == uint16(a.Config.CompressOpCode) {
+		a.negotiateCompress(s, p)
+		return
+	}
+
+	// 新连接提交恢复令牌
+	if a.Config.ResumeTimeout > 0 && p.OpCode() == uint16(a.Config.ResumeOpCode) {
+		a.resume(s, p)
+		return
+	}
+
+	// 未验证会话的登录请求，先进行身份验证
+	if a.authenticator != nil && !s.IsValid() && a.isLogin(p) {
+		a.dispatch(s, a.loginRouter(p.OpCode()), p, nil)
 		return
 	}
 
 	router, ok := a.RouterManager.GetHandleRouter(p.OpCode())
 	if !ok {
+		p.Free()
+		a.metrics.unknownOpCodes.Inc()
 		return
 	}
 
-	go a.asyncHandleMessage(s, router, p)
+	a.dispatch(s, router, p, nil)
+}
+
+// OnDetach 可恢复的会话断线回调，连接已关闭，会话仍然保留
+func (a *App) OnDetach(s *session.Session) {
+	atomic.AddInt32(&a.connCount, -1)
+}
+
+// resume 使用新连接上的临时会话恢复断线的会话，失败时回复空令牌，客户端需要重新登录
+func (a *App) resume(s *session.Session, p network.Packet) {
+	defer p.Free()
+	if s.IsValid() {
+		return
+	}
+
+	if _, err := a.SessionManager.Resume(string(p.Body()), s); err != nil {
+		s.WritePacket(network.PackingOpcode(uint16(a.Config.ResumeOpCode), nil))
+	}
+}
+
+// negotiateCompress 按客户端支持的压缩算法协商当前连接的压缩，回复启用的算法编号，为空表示不压缩；
+// 回复写入之后才压缩发送的报文，保证客户端先收到协商结果
+func (a *App) negotiateCompress(s *session.Session, p network.Packet) {
+	defer p.Free()
+
+	var reply []byte
+	if c := s.AcceptCompressor(p.Body()); c != nil {
+		reply = []byte{c.ID()}
+	}
+	if err := s.WritePacket(network.PackingOpcode(uint16(a.Config.CompressOpCode), reply)); err != nil {
+		return
+	}
+	s.ActivateCompressor()
 }
 
 // OnDisconnect 连接断开回调
 func (a *App) OnDisconnect(s *session.Session) {
-	atomic.AddInt32(&a.connCount, -1)
+	// 断线等待恢复的会话，连接已在 OnDetach 中计数
+	if !s.IsDetached() {
+		atomic.AddInt32(&a.connCount, -1)
+	}
 	a.SessionManager.Del(s)
 	if a.disconnectEvent != nil {
 		a.disconnectEvent(s)
@@ -44,3 +103,21 @@ func (a *App) OnDisconnect(s *session.Session) {
 func (a *App) GetMsgOpCode(msg proto.Message) (uint16, error) {
 	return a.RouterManager.GetMsgOpcode(msg)
 }
+
+// GetMsgCodec 获取消息的编解码器，路由未单独设置时使用 App 的编解码器
+func (a *App) GetMsgCodec(msg proto.Message) codec.Codec {
+	if c := a.RouterManager.GetMsgCodec(msg.ProtoReflect().Descriptor().FullName()); c != nil {
+		return c
+	}
+	return a.codec
+}
+
+// GetKickOpCode 获取断开通知使用的 opcode
+func (a *App) GetKickOpCode() uint16 {
+	return uint16(a.Config.KickOpCode)
+}
+
+// GetLogger 获取会话使用的日志
+func (a *App) GetLogger() logger.Logger {
+	return a.logger
+}
@@ -1,15 +1,18 @@
 package lulu
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/url"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/trainking/lulu/codec"
 	"github.com/trainking/lulu/network"
 	"github.com/xtaci/kcp-go"
-	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
@@ -17,9 +20,18 @@ type (
 	// Client 客户端
 	Client struct {
 		Conn        network.Conn
+		config      *network.Config
+		codec       codec.Codec
 		closeChan   chan struct{}
 		closeOnce   sync.Once
 		receiveChan chan network.Packet
+		errorOpCode uint16 // 错误回复的 opcode，0 表示不解析错误回复
+
+		compressOpCode uint32 // 协商压缩使用的 opcode，0 表示未协商
+
+		seq       uint32                         // 最近一次请求的序列号
+		pending   map[uint32]chan network.Packet // 等待回复的请求
+		pendingMu sync.Mutex
 	}
 )
 
@@ -44,8 +56,11 @@ func NewClient(nw string, config *network.Config) (*Client, error) {
 
 	client := &Client{
 		Conn:        conn,
+		config:      config,
+		codec:       codec.Proto,
 		closeChan:   make(chan struct{}),
 		receiveChan: make(chan network.Packet, 1024),
+		pending:     make(map[uint32]chan network.Packet),
 	}
 
 	go client.receive()
@@ -61,9 +76,10 @@ func newTcpConn(config *network.Config) (network.Conn, error) {
 	}
 
 	if config.TLSConfig != nil {
-		tlsConn := tls.Client(c, config.TLSConfig)
-
-		return network.NewTcpConn(tlsConn, config)
+		c = tls.Client(c, config.TLSConfig)
+	}
+	if config.Cipher != "" {
+		c = network.SecureClient(c, config.Cipher)
 	}
 
 	return network.NewTcpConn(c, config)
@@ -77,15 +93,19 @@ func newKcpConn(config *network.Config) (network.Conn, error) {
 	}
 
 	if config.TLSConfig != nil {
-		tlsConn := tls.Client(c, config.TLSConfig)
-
-		return network.NewKcpConn(tlsConn, config), nil
+		c = tls.Client(c, config.TLSConfig)
+	}
+	if config.Cipher != "" {
+		c = network.SecureClient(c, config.Cipher)
 	}
 	return network.NewKcpConn(c, config), nil
 }
 
-// newWsConn 创建一个websocket连接
+// newWsConn 创建一个websocket连接；websocket 使用 wss 加密，不支持 Cipher
 func newWsConn(config *network.Config) (network.Conn, error) {
+	if config.Cipher != "" {
+		return nil, errors.Wrap(network.ErrCipherNetwork, network.WebSocketNet)
+	}
 	u := url.URL{Scheme: "ws", Host: config.Addr, Path: config.WSUpgradePath}
 	var dialer *websocket.Dialer
 	if config.TLSConfig != nil {
@@ -101,17 +121,102 @@ func newWsConn(config *network.Config) (network.Conn, error) {
 	return network.NewWebSocketConn(c, config, ""), nil
 }
 
+// SetCodec 设置客户端使用的编解码器，需与服务端保持一致，默认为 protobuf
+func (c *Client) SetCodec(cd codec.Codec) {
+	c.codec = cd
+}
+
+// SetErrorOpCode 设置服务端错误回复使用的 opcode，与服务端的 ErrorOpCode 一致；
+// 设置后 Request 收到错误回复时返回 *Error
+func (c *Client) SetErrorOpCode(opcode uint16) {
+	c.errorOpCode = opcode
+}
+
+// Bind 使用客户端的编解码器解码收到的消息
+func (c *Client) Bind(p network.Packet, msg protoreflect.ProtoMessage) error {
+	return c.codec.Unmarshal(p.Body(), msg)
+}
+
 // Send 发送消息
 func (c *Client) Send(opcode uint16, msg protoreflect.ProtoMessage) error {
-	msgB, err := proto.Marshal(msg)
+	msgB, err := c.codec.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	p := network.PackingOpcode(opcode, msgB)
+	p := network.PackingVersionOpcode(c.config.Version(), opcode, msgB)
 
 	return c.Conn.WritePacket(p)
 }
 
+// Request 发送请求，并阻塞等待携带相同序列号的回复，解码到 reply 中；
+// 超时由 ctx 控制，需要连接使用 V2 报文头
+func (c *Client) Request(ctx context.Context, opcode uint16, msg, reply protoreflect.ProtoMessage) error {
+	if c.config.Version() != network.PacketV2 {
+		return network.ErrPacketSeq
+	}
+
+	msgB, err := c.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// 序列号 0 表示没有序列号，需要跳过
+	seq := atomic.AddUint32(&c.seq, 1)
+	if seq == 0 {
+		seq = atomic.AddUint32(&c.seq, 1)
+	}
+
+	replyChan := make(chan network.Packet, 1)
+	c.pendingMu.Lock()
+	c.pending[seq] = replyChan
+	c.pendingMu.Unlock()
+	defer func() {
+		// 超时或关闭后到达的回复已经投递到 replyChan，需要释放
+		c.pendingMu.Lock()
+		delete(c.pending, seq)
+		select {
+		case p := <-replyChan:
+			p.Free()
+		default:
+		}
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.Conn.WritePacket(network.PackingSeqOpcode(opcode, seq, msgB)); err != nil {
+		return err
+	}
+
+	select {
+	case p := <-replyChan:
+		defer p.Free()
+		if c.errorOpCode != 0 && p.OpCode() == c.errorOpCode {
+			e, err := ParseError(p.Body())
+			if err != nil {
+				return err
+			}
+			return e
+		}
+		return c.codec.Unmarshal(p.Body(), reply)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closeChan:
+		return ErrClientClosed
+	}
+}
+
+// Resume 在新连接上提交服务端下发的恢复令牌，恢复断线前的会话；
+// 服务端会使用同一 opcode 回复新的令牌，令牌为空表示恢复失败
+func (c *Client) Resume(opcode uint16, token string) error {
+	return c.Conn.WritePacket(network.PackingVersionOpcode(c.config.Version(), opcode, []byte(token)))
+}
+
+// NegotiateCompress 使用 opcode 向服务端提交本端支持的压缩算法（network.Config 中的 Compressor），
+// 服务端回复启用的算法后双方开始压缩；回复之前，以及服务端回复为空时不压缩
+func (c *Client) NegotiateCompress(opcode uint16) error {
+	atomic.StoreUint32(&c.compressOpCode, uint32(opcode))
+	return c.Conn.WritePacket(network.PackingVersionOpcode(c.config.Version(), opcode, network.CompressOffer(c.config)))
+}
+
 // Close 关闭连接
 func (c *Client) Close() {
 	c.closeOnce.Do(func() {
@@ -144,6 +249,32 @@ func (c *Client) receive() {
 			return
 		}
 
+		// 服务端回复协商的压缩算法，之后的报文按此算法压缩和解压
+		if op := atomic.LoadUint32(&c.compressOpCode); op != 0 && uint32(n.OpCode()) == op {
+			if cc, ok := c.Conn.(network.CompressConn); ok {
+				cc.AcceptCompressor(n.Body())
+				cc.ActivateCompressor()
+			}
+			n.Free()
+			continue
+		}
+
+		// 有请求在等待的回复，交给 Request；等待已超时的回复直接释放。
+		// 持有锁投递，Request 返回时可以取出未读取的回复；replyChan 有缓冲，不会阻塞
+		if seq := n.Seq(); seq != 0 {
+			c.pendingMu.Lock()
+			replyChan, ok := c.pending[seq]
+			delete(c.pending, seq)
+			if ok {
+				replyChan <- n
+			}
+			c.pendingMu.Unlock()
+			if !ok {
+				n.Free()
+			}
+			continue
+		}
+
 		if n.OpCode() > 0 {
 			c.receiveChan <- n
 		}
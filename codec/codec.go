@@ -0,0 +1,84 @@
+/*
+codec 定义消息的编解码抽象，将 Handler 与具体的传输格式解耦。
+*/
+package codec
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ProtoName = "proto"
+	JSONName  = "json"
+)
+
+var (
+	// Proto protobuf 二进制编解码，框架默认使用
+	Proto Codec = protoCodec{}
+
+	// JSON protobuf 的 JSON 映射编解码，便于 web 工具调试
+	JSON Codec = jsonCodec{}
+
+	codecs   = map[string]Codec{ProtoName: Proto, JSONName: JSON}
+	codecsMu sync.RWMutex
+)
+
+type (
+	// Codec 消息编解码器
+	Codec interface {
+		// Name 编解码器的名字，与配置中的 Codec 对应
+		Name() string
+
+		// Marshal 编码消息
+		Marshal(m proto.Message) ([]byte, error)
+
+		// Unmarshal 解码消息
+		Unmarshal(data []byte, m proto.Message) error
+	}
+
+	protoCodec struct{}
+
+	jsonCodec struct{}
+)
+
+// Register 注册编解码器，同名会覆盖；如需 MessagePack 等格式，可自行实现后注册
+func Register(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// Get 通过名字获取编解码器
+func Get(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+func (protoCodec) Name() string {
+	return ProtoName
+}
+
+func (protoCodec) Marshal(m proto.Message) ([]byte, error) {
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, m proto.Message) error {
+	return proto.Unmarshal(data, m)
+}
+
+func (jsonCodec) Name() string {
+	return JSONName
+}
+
+func (jsonCodec) Marshal(m proto.Message) ([]byte, error) {
+	return protojson.Marshal(m)
+}
+
+func (jsonCodec) Unmarshal(data []byte, m proto.Message) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+}
@@ -3,25 +3,71 @@ package lulu
 import (
 	"os"
 
+	"github.com/trainking/lulu/codec"
+	"github.com/trainking/lulu/logger"
+	"github.com/trainking/lulu/network"
+	"github.com/trainking/lulu/session"
 	"gopkg.in/yaml.v3"
 )
 
 type (
 	// Config gamex的基础配置内容
 	Config struct {
-		Version          string   `yaml:"Version"`                    // 服务的版本号
-		Address          string   `yaml:"Address"`                    // 监听的地址
-		NetWork          string   `yaml:"Network"`                    // 传输层协议，tcp, kcp，websocket
-		WebsocketPath    string   `yaml:"WebsocketPath,omitempty"`    // websocket时使用升级路径
-		KcpMode          string   `yaml:"KcpMode,omitempty"`          // kcp模式，nomarl 普通模式 fast 极速模式；默认极速模式
-		ConnReadTimeout  int      `yaml:"ConnReadTimeout,omitempty"`  // 每个连接的读超时(等于客户端心跳的超时)，秒为单位， 默认10秒
-		ConnWriteTimeout int      `yaml:"ConnWriteTimeout,omitempty"` // 每个连接的写超时，秒为单位，默认5秒
-		ConnMax          int      `yaml:"ConnMax,omitempty"`          // 最大连接数， 默认10000
-		ValidTimeout     int      `yaml:"ValidTimeout,omitempty"`     // 有效链接超时；连接成功后，多久未验证身份，则断开，秒为单位, 默认10秒
-		HeartLimit       int      `yaml:"HeartLimit,omitempty"`       // 心跳包限制数量, 每分钟不能超过的数量，默认100
-		Password         string   `yaml:"Password,omitempty"`         // 密码
-		OutUrl           string   `yaml:"OutUrl,omitempty"`           // 外部访问的URL
-		TLS              *TLSConf `yaml:"TLS,omitempty"`              // TLS配置
+		Version           string   `yaml:"Version"`                     // 服务的版本号
+		Address           string   `yaml:"Address"`                     // 监听的地址
+		NetWork           string   `yaml:"Network"`                     // 传输层协议，tcp, kcp，websocket
+		WebsocketPath     string   `yaml:"WebsocketPath,omitempty"`     // websocket时使用升级路径
+		KcpMode           string   `yaml:"KcpMode,omitempty"`           // kcp模式，nomarl 普通模式 fast 极速模式；默认极速模式
+		ConnReadTimeout   int      `yaml:"ConnReadTimeout,omitempty"`   // 每个连接的读超时(等于客户端心跳的超时)，秒为单位， 默认10秒
+		ConnWriteTimeout  int      `yaml:"ConnWriteTimeout,omitempty"`  // 每个连接的写超时，秒为单位，默认5秒
+		ConnMax           int      `yaml:"ConnMax,omitempty"`           // 最大连接数， 默认10000
+		ValidTimeout      int      `yaml:"ValidTimeout,omitempty"`      // 有效链接超时；连接成功后，多久未验证身份，则断开，秒为单位, 默认10秒
+		HeartLimit        int      `yaml:"HeartLimit,omitempty"`        // 心跳包限制数量, 每分钟不能超过的数量，默认100
+		Password          string   `yaml:"Password,omitempty"`          // 密码
+		OutUrl            string   `yaml:"OutUrl,omitempty"`            // 外部访问的URL
+		TLS               *TLSConf `yaml:"TLS,omitempty"`               // TLS配置
+		PacketVersion     int      `yaml:"PacketVersion,omitempty"`     // 报文头版本，1 为 2字节长度的旧版报文头，2 为带标志位和 4 字节长度的扩展报文头；默认 1
+		Codec             string   `yaml:"Codec,omitempty"`             // 消息编解码器，proto, json 或自行注册的编解码器；默认 proto
+		ShutdownTimeout   int      `yaml:"ShutdownTimeout,omitempty"`   // 关闭时等待处理中消息的最长时间，秒为单位，默认10秒，-1表示不等待
+		DispatchMode      string   `yaml:"DispatchMode,omitempty"`      // 消息分发模式，goroutine 每个消息一个协程，session 每个会话串行处理，pool 全局工作协程池；默认 goroutine
+		SessionQueue      int      `yaml:"SessionQueue,omitempty"`      // session 模式下每个会话的消息队列长度，默认64
+		WorkerNum         int      `yaml:"WorkerNum,omitempty"`         // pool 模式下工作协程数量，默认 CPU 核数的两倍
+		WorkerQueue       int      `yaml:"WorkerQueue,omitempty"`       // pool 模式下消息队列长度，默认1024
+		ResumeTimeout     int      `yaml:"ResumeTimeout,omitempty"`     // 会话断线后等待恢复的宽限期，秒为单位；0 表示不开启会话恢复
+		ResumeOpCode      int      `yaml:"ResumeOpCode,omitempty"`      // 下发和提交恢复令牌使用的 opcode，默认65534
+		ResumePending     int      `yaml:"ResumePending,omitempty"`     // 断线期间最多缓存的待发送消息数量，默认128
+		KickOpCode        int      `yaml:"KickOpCode,omitempty"`        // 服务端断开通知使用的 opcode，默认65535
+		ErrorOpCode       int      `yaml:"ErrorOpCode,omitempty"`       // 请求失败时回复错误使用的 opcode，0 表示不回复错误
+		LoginOpCode       int      `yaml:"LoginOpCode,omitempty"`       // 设置身份验证后，登录请求的 opcode；0 表示未验证会话的任意请求都视为登录请求
+		LogLevel          string   `yaml:"LogLevel,omitempty"`          // 日志级别，debug, info, warn, error；默认 info
+		LogFormat         string   `yaml:"LogFormat,omitempty"`         // 日志格式，text 或 json；默认 text
+		MetricsAddress    string   `yaml:"MetricsAddress,omitempty"`    // 指标 HTTP 服务的监听地址，为空时不开启
+		MetricsPath       string   `yaml:"MetricsPath,omitempty"`       // 指标 HTTP 服务的路径，默认 /metrics
+		AdminAddress      string   `yaml:"AdminAddress,omitempty"`      // 管理接口 HTTP 服务的监听地址，为空时不开启；使用 Password 鉴权
+		StrictRoute       bool     `yaml:"StrictRoute,omitempty"`       // 严格路由模式，存在注册失败的路由时 Run 直接 panic；默认只记录错误日志
+		DuplicateLogin    string   `yaml:"DuplicateLogin,omitempty"`    // 重复登录策略，kick_old 踢掉旧会话，reject_new 拒绝新会话，multi_device 不同设备可同时在线；默认 kick_old
+		MaxUserSessions   int      `yaml:"MaxUserSessions,omitempty"`   // 每个玩家同时在线的最大会话数，多设备登录时超出后踢掉最早登录的会话；默认5
+		TicketSecret      string   `yaml:"TicketSecret,omitempty"`      // 登录票据的 HMAC-SHA256 密钥，与登录服一致
+		TicketSkew        int      `yaml:"TicketSkew,omitempty"`        // 校验票据有效期时允许的时钟偏差，秒为单位，默认30秒
+		Cipher            string   `yaml:"Cipher,omitempty"`            // tcp 和 kcp 的报文加密算法，chacha20-poly1305 或 aes-gcm；为空时不加密
+		Compressor        string   `yaml:"Compressor,omitempty"`        // 发送报文的压缩算法，flate, zlib, snappy 或自行注册的算法；为空时不压缩，只对 V2 报文头生效
+		CompressThreshold int      `yaml:"CompressThreshold,omitempty"` // 包体不小于此字节数时压缩，默认1024
+		CompressOpCode    int      `yaml:"CompressOpCode,omitempty"`    // 客户端协商压缩算法使用的 opcode，默认65532
+		MaxDecompressSize int      `yaml:"MaxDecompressSize,omitempty"` // 收到的压缩报文解压后包体的最大字节数，超过时断开连接，默认1048576
+
+		Listeners []ListenerConf `yaml:"Listeners,omitempty"` // 多个监听器配置，设置后忽略 Network, Address 等单监听器配置
+	}
+
+	// ListenerConf 监听器配置，未设置的选项使用 Config 中的同名配置
+	ListenerConf struct {
+		NetWork       string   `yaml:"Network"`                 // 传输层协议，tcp, kcp，websocket
+		Address       string   `yaml:"Address"`                 // 监听的地址
+		WebsocketPath string   `yaml:"WebsocketPath,omitempty"` // websocket时使用升级路径
+		KcpMode       string   `yaml:"KcpMode,omitempty"`       // kcp模式
+		PacketVersion int      `yaml:"PacketVersion,omitempty"` // 报文头版本
+		TLS           *TLSConf `yaml:"TLS,omitempty"`           // TLS配置
+		NoTLS         bool     `yaml:"NoTLS,omitempty"`         // 不使用 TLS，即使 Config 中配置了 TLS
+		Cipher        string   `yaml:"Cipher,omitempty"`        // 报文加密算法，websocket 监听器不使用 Config 中的配置
 	}
 
 	// TLSConf TLS配置结构体
@@ -83,4 +129,106 @@ func (c *Config) defaultValue() {
 	if c.ValidTimeout == 0 {
 		c.ValidTimeout = 10
 	}
+
+	if c.PacketVersion == 0 {
+		c.PacketVersion = int(network.PacketV1)
+	}
+
+	if c.Codec == "" {
+		c.Codec = codec.ProtoName
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 10
+	}
+
+	if c.DispatchMode == "" {
+		c.DispatchMode = DispatchGoroutine
+	}
+
+	if c.ResumeOpCode == 0 {
+		c.ResumeOpCode = 65534
+	}
+
+	if c.ResumePending == 0 {
+		c.ResumePending = 128
+	}
+
+	if c.KickOpCode == 0 {
+		c.KickOpCode = 65535
+	}
+
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+
+	if c.LogFormat == "" {
+		c.LogFormat = logger.FormatText
+	}
+
+	if c.MetricsPath == "" {
+		c.MetricsPath = "/metrics"
+	}
+
+	if c.DuplicateLogin == "" {
+		c.DuplicateLogin = string(session.DuplicateKickOld)
+	}
+
+	if c.MaxUserSessions == 0 {
+		c.MaxUserSessions = session.DefaultMaxUserSessions
+	}
+
+	if c.TicketSkew == 0 {
+		c.TicketSkew = 30
+	}
+
+	if c.CompressThreshold == 0 {
+		c.CompressThreshold = network.DefaultCompressThreshold
+	}
+
+	if c.CompressOpCode == 0 {
+		c.CompressOpCode = 65532
+	}
+
+	if c.MaxDecompressSize == 0 {
+		c.MaxDecompressSize = network.DefaultMaxDecompressSize
+	}
+}
+
+// ListenerConfs 返回所有监听器的配置；未配置 Listeners 时，使用单监听器配置
+func (c *Config) ListenerConfs() []ListenerConf {
+	if len(c.Listeners) == 0 {
+		return []ListenerConf{{
+			NetWork:       c.NetWork,
+			Address:       c.Address,
+			WebsocketPath: c.WebsocketPath,
+			KcpMode:       c.KcpMode,
+			PacketVersion: c.PacketVersion,
+			TLS:           c.TLS,
+			Cipher:        c.Cipher,
+		}}
+	}
+
+	confs := make([]ListenerConf, len(c.Listeners))
+	for i, lc := range c.Listeners {
+		if lc.WebsocketPath == "" {
+			lc.WebsocketPath = c.WebsocketPath
+		}
+		if lc.KcpMode == "" {
+			lc.KcpMode = c.KcpMode
+		}
+		if lc.PacketVersion == 0 {
+			lc.PacketVersion = c.PacketVersion
+		}
+		if lc.NoTLS {
+			lc.TLS = nil
+		} else if lc.TLS == nil {
+			lc.TLS = c.TLS
+		}
+		if lc.Cipher == "" && lc.NetWork != network.WebSocketNet {
+			lc.Cipher = c.Cipher
+		}
+		confs[i] = lc
+	}
+	return confs
 }
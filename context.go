@@ -3,6 +3,8 @@ package lulu
 import (
 	"context"
 
+	"github.com/trainking/lulu/codec"
+	"github.com/trainking/lulu/network"
 	"github.com/trainking/lulu/session"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -15,9 +17,18 @@ type (
 		// Context 返回一个context.Context
 		Context() context.Context
 
+		// SetContext 替换 context.Context，用于中间件设置超时或传递数据
+		SetContext(ctx context.Context)
+
 		// Bind 取出请求参数
 		Bind(m protoreflect.ProtoMessage) error
 
+		// Message 获取按注册类型解码后的请求消息
+		Message() proto.Message
+
+		// SetMessage 替换请求消息
+		SetMessage(msg proto.Message)
+
 		// Session 获取这个玩家的Session
 		Session() *session.Session
 
@@ -26,6 +37,21 @@ type (
 
 		// GetOpCode 获取此次请求的opcode
 		GetOpCode() uint16
+
+		// Codec 获取此次请求使用的编解码器
+		Codec() codec.Codec
+
+		// Seq 获取此次请求的序列号，客户端未携带时为 0
+		Seq() uint32
+
+		// Reply 回复此次请求，回复消息会携带请求的序列号
+		Reply(msg proto.Message) error
+
+		// Get 获取会话属性
+		Get(key string) (interface{}, bool)
+
+		// Set 设置会话属性
+		Set(key string, value interface{})
 	}
 
 	// DefaultContext 默认Context实现
@@ -34,19 +60,28 @@ type (
 		session *session.Session
 		ctx     context.Context
 		opcode  uint16
+		seq     uint32
 		body    []byte
+		codec   codec.Codec
+		msg     proto.Message
+
+		decoder   func() (proto.Message, error) // 按路由注册的类型解码请求消息，第一次读取消息时执行
+		decoded   bool
+		decodeErr error
 	}
 )
 
 // NewContext 创建一个Context，提供给Handler使用
-func NewContext(ctx context.Context, a *App, session *session.Session, opcode uint16, body []byte) Context {
+func NewContext(ctx context.Context, a *App, session *session.Session, p network.Packet, c codec.Codec) Context {
 
 	return &DefaultContext{
 		a:       a,
 		session: session,
 		ctx:     ctx,
-		opcode:  opcode,
-		body:    body,
+		opcode:  p.OpCode(),
+		seq:     p.Seq(),
+		body:    p.Body(),
+		codec:   c,
 	}
 }
 
@@ -55,9 +90,43 @@ func (c *DefaultContext) Context() context.Context {
 	return c.ctx
 }
 
-// Bind 取出请求参数
+// SetContext 替换 context.Context
+func (c *DefaultContext) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// Bind 取出请求参数；App.Call 触发的内部路由没有包体，复制传入的消息
 func (c *DefaultContext) Bind(m protoreflect.ProtoMessage) error {
-	return proto.Unmarshal(c.body, m)
+	if len(c.body) == 0 && c.msg != nil && c.msg.ProtoReflect().Descriptor() == m.ProtoReflect().Descriptor() {
+		proto.Reset(m)
+		proto.Merge(m, c.msg)
+		return nil
+	}
+	return c.codec.Unmarshal(c.body, m)
+}
+
+// Message 获取按注册类型解码后的请求消息，第一次调用时解码；解码或校验失败时为 nil，
+// 此时请求不会执行到 Handler
+func (c *DefaultContext) Message() proto.Message {
+	c.loadMessage()
+	return c.msg
+}
+
+// SetMessage 替换请求消息
+func (c *DefaultContext) SetMessage(msg proto.Message) {
+	c.msg = msg
+	c.decoded = true
+}
+
+// loadMessage 解码请求消息，只解码一次，返回解码的错误
+func (c *DefaultContext) loadMessage() error {
+	if !c.decoded {
+		c.decoded = true
+		if c.decoder != nil {
+			c.msg, c.decodeErr = c.decoder()
+		}
+	}
+	return c.decodeErr
 }
 
 // Session 获取这个玩家的Session
@@ -74,3 +143,28 @@ func (c *DefaultContext) App() *App {
 func (c *DefaultContext) GetOpCode() uint16 {
 	return c.opcode
 }
+
+// Codec 获取此次请求使用的编解码器
+func (c *DefaultContext) Codec() codec.Codec {
+	return c.codec
+}
+
+// Seq 获取此次请求的序列号
+func (c *DefaultContext) Seq() uint32 {
+	return c.seq
+}
+
+// Reply 回复此次请求
+func (c *DefaultContext) Reply(msg proto.Message) error {
+	return c.session.Reply(c.seq, msg)
+}
+
+// Get 获取会话属性
+func (c *DefaultContext) Get(key string) (interface{}, bool) {
+	return c.session.Get(key)
+}
+
+// Set 设置会话属性
+func (c *DefaultContext) Set(key string, value interface{}) {
+	c.session.Set(key, value)
+}
@@ -0,0 +1,180 @@
+package lulu
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/trainking/lulu/session"
+)
+
+const (
+	DispatchGoroutine = "goroutine" // 每个消息一个协程，不保证顺序，不限制数量
+	DispatchSession   = "session"   // 每个会话一个串行信箱，同一会话的消息按顺序处理
+	DispatchPool      = "pool"      // 全局固定数量的工作协程，队列有上限
+)
+
+type (
+	// dispatcher 消息分发器，决定消息在哪个协程中处理
+	dispatcher interface {
+		// Dispatch 投递任务，会话的消息队列已满时返回 ErrMailboxFull，
+		// 全局队列已满或会话已关闭时返回 ErrDispatchRejected
+		Dispatch(s *session.Session, task func()) error
+
+		// Close 关闭分发器
+		Close()
+	}
+
+	// goroutineDispatcher 每个任务一个协程
+	goroutineDispatcher struct{}
+
+	// poolDispatcher 固定数量的工作协程
+	poolDispatcher struct {
+		tasks chan func()
+	}
+
+	// sessionDispatcher 每个会话一个串行信箱
+	sessionDispatcher struct {
+		queueSize int
+		mailboxes map[*session.Session]*mailbox
+		mu        sync.Mutex
+	}
+
+	// mailbox 会话的串行信箱
+	mailbox struct {
+		tasks  chan func()
+		closed bool
+		mu     sync.Mutex
+	}
+)
+
+// newDispatcher 根据配置创建分发器
+func newDispatcher(c *Config) dispatcher {
+	switch c.DispatchMode {
+	case DispatchSession:
+		queueSize := c.SessionQueue
+		if queueSize <= 0 {
+			queueSize = 64
+		}
+		return newSessionDispatcher(queueSize)
+	case DispatchPool:
+		workerNum := c.WorkerNum
+		if workerNum <= 0 {
+			workerNum = runtime.NumCPU() * 2
+		}
+		queueSize := c.WorkerQueue
+		if queueSize <= 0 {
+			queueSize = 1024
+		}
+		return newPoolDispatcher(workerNum, queueSize)
+	default:
+		return goroutineDispatcher{}
+	}
+}
+
+func (goroutineDispatcher) Dispatch(s *session.Session, task func()) error {
+	go task()
+	return nil
+}
+
+func (goroutineDispatcher) Close() {}
+
+// newPoolDispatcher 创建工作协程池
+func newPoolDispatcher(workerNum int, queueSize int) *poolDispatcher {
+	d := &poolDispatcher{
+		tasks: make(chan func(), queueSize),
+	}
+
+	for i := 0; i < workerNum; i++ {
+		go func() {
+			for task := range d.tasks {
+				task()
+			}
+		}()
+	}
+
+	return d
+}
+
+func (d *poolDispatcher) Dispatch(s *session.Session, task func()) error {
+	select {
+	case d.tasks <- task:
+		return nil
+	default:
+		return ErrDispatchRejected
+	}
+}
+
+// Close 关闭任务队列，工作协程处理完剩余任务后退出
+func (d *poolDispatcher) Close() {
+	close(d.tasks)
+}
+
+// newSessionDispatcher 创建会话信箱分发器
+func newSessionDispatcher(queueSize int) *sessionDispatcher {
+	return &sessionDispatcher{
+		queueSize: queueSize,
+		mailboxes: make(map[*session.Session]*mailbox),
+	}
+}
+
+func (d *sessionDispatcher) Dispatch(s *session.Session, task func()) error {
+	d.mu.Lock()
+	m, ok := d.mailboxes[s]
+	if !ok {
+		// 已关闭的会话不再创建信箱
+		select {
+		case <-s.Done():
+			d.mu.Unlock()
+			return ErrDispatchRejected
+		default:
+		}
+
+		m = &mailbox{tasks: make(chan func(), d.queueSize)}
+		d.mailboxes[s] = m
+		go d.run(s, m)
+	}
+	d.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrDispatchRejected
+	}
+
+	select {
+	case m.tasks <- task:
+		return nil
+	default:
+		return ErrMailboxFull
+	}
+}
+
+// run 串行处理会话的任务，会话关闭后处理完剩余任务再退出
+func (d *sessionDispatcher) run(s *session.Session, m *mailbox) {
+	for {
+		select {
+		case task := <-m.tasks:
+			task()
+		case <-s.Done():
+			m.mu.Lock()
+			m.closed = true
+			m.mu.Unlock()
+
+			for {
+				select {
+				case task := <-m.tasks:
+					task()
+				default:
+					d.mu.Lock()
+					if d.mailboxes[s] == m {
+						delete(d.mailboxes, s)
+					}
+					d.mu.Unlock()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *sessionDispatcher) Close() {}
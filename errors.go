@@ -1,9 +1,105 @@
 package lulu
 
-import "errors"
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrNoRegister     = errors.New("no register router") // 路由未被注册
-	ErrSessionInvalid = errors.New("session invalid")    // session无效
-	ErrOpCode         = errors.New("wrong opcode")       // 错误的OpCode
+	ErrNoRegister       = errors.New("no register router")    // 路由未被注册
+	ErrSessionInvalid   = errors.New("session invalid")       // session无效
+	ErrOpCode           = errors.New("wrong opcode")          // 错误的OpCode
+	ErrNoCodec          = errors.New("no register codec")     // 编解码器未注册
+	ErrClientClosed     = errors.New("client closed")         // 客户端已关闭
+	ErrDispatchRejected = errors.New("dispatch rejected")     // 分发队列已满或会话已关闭
+	ErrDuplicateOpCode  = errors.New("duplicate opcode")      // 同类路由的 opcode 重复
+	ErrDuplicateName    = errors.New("duplicate message")     // 同类路由的消息重复
+	ErrRouteRegister    = errors.New("route register")        // 存在注册失败的路由
+	ErrOpCodeRange      = errors.New("opcode out of range")   // opcode 不在允许的范围内
+	ErrOpCodeReserved   = errors.New("opcode reserved")       // opcode 已被框架使用
+	ErrDecode           = errors.New("decode request")        // 请求消息解码失败
+	ErrPanic            = errors.New("handler panic")         // Handler 发生 panic
+	ErrRateLimited      = errors.New("rate limited")          // 请求频率超过限制
+	ErrValidate         = errors.New("validate request")      // 请求消息校验失败
+	ErrAuthFailed       = errors.New("authentication failed") // 身份验证失败
+	ErrErrorPacket      = errors.New("wrong error packet")    // 错误回复报文格式错误
+	ErrDuplicateLogin   = errors.New("duplicate login")       // 重复登录策略拒绝了新会话
+	ErrTicketSecret     = errors.New("empty ticket secret")   // 未配置票据密钥
+	ErrTicketInvalid    = errors.New("invalid ticket")        // 票据格式或签名错误
+	ErrTicketExpired    = errors.New("ticket expired")        // 票据已过期
+	ErrTicketReplayed   = errors.New("ticket replayed")       // 票据已被使用
+	ErrMailboxFull      = errors.New("session mailbox full")  // 会话的消息队列已满
+)
+
+// 框架内置的错误码，业务错误码建议从 1000 开始
+const (
+	CodeInternal       uint32 = iota + 1 // 内部错误，未使用 Error 的错误都会被屏蔽为此错误码
+	CodeBadRequest                       // 请求解码或校验失败
+	CodeUnauthorized                     // 会话未验证
+	CodeRateLimited                      // 请求频率超过限制
+	CodeTimeout                          // 处理超时
+	CodeAuthFailed                       // 身份验证失败
+	CodeDuplicateLogin                   // 玩家已在线，重复登录被拒绝
 )
+
+// Error 返回给客户端的错误，包含错误码和错误信息
+type Error struct {
+	Code    uint32
+	Message string
+}
+
+// NewError 创建返回给客户端的错误
+func NewError(code uint32, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Errorf 创建返回给客户端的错误，错误信息按 format 格式化
+func Errorf(code uint32, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("code %d: %s", e.Code, e.Message)
+}
+
+// toError 将 Handler 返回的错误转换为返回给客户端的错误，框架错误转换为对应的错误码，
+// 其他错误屏蔽为 CodeInternal
+func toError(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, ErrDecode), errors.Is(err, ErrValidate):
+		return NewError(CodeBadRequest, "bad request")
+	case errors.Is(err, ErrAuthFailed):
+		return NewError(CodeAuthFailed, "authentication failed")
+	case errors.Is(err, ErrDuplicateLogin):
+		return NewError(CodeDuplicateLogin, "duplicate login")
+	case errors.Is(err, ErrSessionInvalid):
+		return NewError(CodeUnauthorized, "unauthorized")
+	case errors.Is(err, ErrRateLimited):
+		return NewError(CodeRateLimited, "rate limited")
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewError(CodeTimeout, "timeout")
+	default:
+		return NewError(CodeInternal, "internal error")
+	}
+}
+
+// marshal 错误回复的包体：4 字节的错误码，后跟错误信息
+func (e *Error) marshal() []byte {
+	body := make([]byte, 4+len(e.Message))
+	binary.BigEndian.PutUint32(body[:4], e.Code)
+	copy(body[4:], e.Message)
+	return body
+}
+
+// ParseError 解析错误回复报文的包体
+func ParseError(body []byte) (*Error, error) {
+	if len(body) < 4 {
+		return nil, ErrErrorPacket
+	}
+	return &Error{Code: binary.BigEndian.Uint32(body[:4]), Message: string(body[4:])}, nil
+}
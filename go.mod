@@ -3,9 +3,11 @@ module github.com/trainking/lulu
 go 1.17
 
 require (
+	github.com/golang/snappy v0.0.4
 	github.com/gorilla/websocket v1.5.1
 	github.com/pkg/errors v0.9.1
 	github.com/xtaci/kcp-go v5.4.20+incompatible
+	golang.org/x/crypto v0.21.0
 	google.golang.org/protobuf v1.23.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -17,7 +19,6 @@ require (
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
-	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
 )
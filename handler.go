@@ -5,5 +5,14 @@ import "github.com/trainking/lulu/session"
 // Handler 处理函数，对玩家请求，和内部处理的入口handler
 type Handler func(Context) error
 
+// ErrorHandler 错误处理函数，请求解码、校验失败或 Handler 返回错误时调用
+type ErrorHandler func(Context, error)
+
+// Validator 请求消息的校验接口，与 protoc-gen-validate 生成的方法一致；
+// 请求消息实现此接口时，解码后会先校验再交给 Handler
+type Validator interface {
+	Validate() error
+}
+
 // SessionEvent 会话事件，连接，断连
 type SessionEvent func(*session.Session) error
@@ -0,0 +1,250 @@
+/*
+logger 定义框架使用的结构化日志接口，以及默认的文本/JSON 实现。
+*/
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DebugLevel Level = iota // 调试
+	InfoLevel               // 信息
+	WarnLevel               // 警告
+	ErrorLevel              // 错误
+)
+
+const (
+	FormatText = "text" // 文本格式，key=value
+	FormatJSON = "json" // JSON 格式，每行一个对象
+)
+
+// 框架事件常用的字段名
+const (
+	KeyUserID    = "user_id"
+	KeySessionID = "session_id"
+	KeyOpCode    = "opcode"
+	KeyRemoteIP  = "remote_ip"
+	KeyError     = "error"
+)
+
+type (
+	// Level 日志级别
+	Level int8
+
+	// Field 日志的键值字段
+	Field struct {
+		Key   string
+		Value interface{}
+	}
+
+	// Logger 结构化日志接口
+	Logger interface {
+		// Debug 调试日志
+		Debug(msg string, fields ...Field)
+
+		// Info 信息日志
+		Info(msg string, fields ...Field)
+
+		// Warn 警告日志
+		Warn(msg string, fields ...Field)
+
+		// Error 错误日志
+		Error(msg string, fields ...Field)
+
+		// With 返回一个附带固定字段的 Logger
+		With(fields ...Field) Logger
+	}
+
+	// stdLogger 默认的日志实现
+	stdLogger struct {
+		out    *output
+		level  Level
+		json   bool
+		fields []Field
+	}
+
+	// output 共享的输出，保证多行日志不交错
+	output struct {
+		w  io.Writer
+		mu sync.Mutex
+	}
+
+	// nopLogger 丢弃所有日志
+	nopLogger struct{}
+)
+
+var defaultLogger = New(os.Stderr, InfoLevel, FormatText)
+
+// Default 返回默认的日志，输出到标准错误，级别为 Info
+func Default() Logger {
+	return defaultLogger
+}
+
+// Nop 返回一个丢弃所有日志的 Logger
+func Nop() Logger {
+	return nopLogger{}
+}
+
+// New 创建日志，format 为 FormatText 或 FormatJSON
+func New(w io.Writer, level Level, format string) Logger {
+	return &stdLogger{
+		out:   &output{w: w},
+		level: level,
+		json:  format == FormatJSON,
+	}
+}
+
+// ParseLevel 解析日志级别，无法识别时为 Info
+func ParseLevel(s string) Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel
+	case "warn", "warning":
+		return WarnLevel
+	case "error":
+		return ErrorLevel
+	default:
+		return InfoLevel
+	}
+}
+
+// String 日志级别的名字
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// Any 任意类型的字段
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// String 字符串字段
+func String(key string, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Int 整数字段
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Uint64 无符号整数字段
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err 错误字段，key 为 KeyError
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: KeyError, Value: nil}
+	}
+	return Field{Key: KeyError, Value: err.Error()}
+}
+
+func (l *stdLogger) Debug(msg string, fields ...Field) {
+	l.log(DebugLevel, msg, fields)
+}
+
+func (l *stdLogger) Info(msg string, fields ...Field) {
+	l.log(InfoLevel, msg, fields)
+}
+
+func (l *stdLogger) Warn(msg string, fields ...Field) {
+	l.log(WarnLevel, msg, fields)
+}
+
+func (l *stdLogger) Error(msg string, fields ...Field) {
+	l.log(ErrorLevel, msg, fields)
+}
+
+func (l *stdLogger) With(fields ...Field) Logger {
+	nl := *l
+	nl.fields = make([]Field, 0, len(l.fields)+len(fields))
+	nl.fields = append(nl.fields, l.fields...)
+	nl.fields = append(nl.fields, fields...)
+	return &nl
+}
+
+// log 按格式输出一行日志
+func (l *stdLogger) log(level Level, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	var line []byte
+	if l.json {
+		line = l.jsonLine(now, level, msg, fields)
+	} else {
+		line = l.textLine(now, level, msg, fields)
+	}
+
+	l.out.mu.Lock()
+	l.out.w.Write(line)
+	l.out.mu.Unlock()
+}
+
+// textLine 文本格式：时间 级别 消息 key=value...
+func (l *stdLogger) textLine(now string, level Level, msg string, fields []Field) []byte {
+	var b strings.Builder
+	b.WriteString(now)
+	b.WriteByte('\t')
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte('\t')
+	b.WriteString(msg)
+	for _, f := range l.fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// jsonLine JSON 格式：{"time":..., "level":..., "msg":..., key:value...}
+func (l *stdLogger) jsonLine(now string, level Level, msg string, fields []Field) []byte {
+	m := make(map[string]interface{}, 3+len(l.fields)+len(fields))
+	for _, f := range l.fields {
+		m[f.Key] = f.Value
+	}
+	for _, f := range fields {
+		m[f.Key] = f.Value
+	}
+	m["time"] = now
+	m["level"] = level.String()
+	m["msg"] = msg
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  now,
+			"level": level.String(),
+			"msg":   msg,
+			"error": err.Error(),
+		})
+	}
+	return append(b, '\n')
+}
+
+func (nopLogger) Debug(msg string, fields ...Field) {}
+func (nopLogger) Info(msg string, fields ...Field)  {}
+func (nopLogger) Warn(msg string, fields ...Field)  {}
+func (nopLogger) Error(msg string, fields ...Field) {}
+func (n nopLogger) With(fields ...Field) Logger     { return n }
@@ -8,13 +8,18 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/trainking/lulu/codec"
+	"github.com/trainking/lulu/logger"
 	"github.com/trainking/lulu/network"
 	"github.com/trainking/lulu/session"
 	"google.golang.org/protobuf/proto"
@@ -35,16 +40,31 @@ lulu is start!
 type (
 	// App 游戏服务器应用实现
 	App struct {
-		listener        network.Listener        // 网络监听
+		listeners       []network.Listener      // 网络监听
 		Config          *Config                 // 系统配置
 		SessionManager  *session.SessionManager // 会话管理器
 		RouterManager   *RouterManager          // 路由管理器
-		exitChan        chan struct{}           // 退出通知
+		exitChan        chan struct{}           // 退出通知，停止接收新连接
 		exitOnce        sync.Once               // 退出单例控制
+		drainChan       chan struct{}           // 排空完成通知，此后销毁所有会话
+		closing         bool                    // 是否正在关闭，关闭后不再处理新消息
+		handleMu        sync.RWMutex            // 保护 closing 与 handleWg 的并发访问
+		handleWg        sync.WaitGroup          // 处理中的消息
+		shutdownMsg     proto.Message           // 关闭时通知所有会话的消息
+		dispatcher      dispatcher              // 消息分发器
 		modules         []Module                // 模块列表
 		connectEvent    SessionEvent            // 连接事件
 		disconnectEvent SessionEvent            // 断连事件
 		connCount       int32                   // 当前连接数
+		codec           codec.Codec             // 默认编解码器
+		logger          logger.Logger           // 日志
+		metrics         *appMetrics             // 内置指标
+		metricsServer   *http.Server            // 指标的 HTTP 服务
+		adminServer     *http.Server            // 管理接口的 HTTP 服务
+		errorHandler    ErrorHandler            // 错误处理函数
+		middleware      []Middleware            // 全局中间件
+		authenticator   Authenticator           // 身份验证
+		httpHandler     http.Handler            // websocket 监听器处理升级路径以外请求的 Handler
 	}
 )
 
@@ -53,6 +73,7 @@ func New(config *Config) *App {
 	app := new(App)
 	app.Config = config
 	app.exitChan = make(chan struct{})
+	app.drainChan = make(chan struct{})
 
 	app.init()
 	return app
@@ -60,35 +81,111 @@ func New(config *Config) *App {
 
 // init 对服务器进行初始化
 func (app *App) init() {
-	var err error
+	// 初始化日志
+	app.logger = logger.New(os.Stdout, logger.ParseLevel(app.Config.LogLevel), app.Config.LogFormat)
 
-	// 初始化 Listener
-	lF := network.NewListenerFactory(app.Config.NetWork, app.Config.Address, app.Config.ConnWriteTimeout, app.Config.ConnReadTimeout)
-	if app.Config.TLS != nil {
-		cert, err := tls.LoadX509KeyPair(app.Config.TLS.CertFile, app.Config.TLS.KeyFile)
+	// 初始化编解码器，配置为空时使用 protobuf
+	app.codec = codec.Proto
+	if app.Config.Codec != "" {
+		c, ok := codec.Get(app.Config.Codec)
+		if !ok {
+			panic(ErrNoCodec)
+		}
+		app.codec = c
+	}
+
+	// 初始化消息分发器
+	app.dispatcher = newDispatcher(app.Config)
+
+	// 初始化会话管理器
+	app.SessionManager = session.NewSessionManager()
+	app.SessionManager.SetDuplicatePolicy(session.DuplicatePolicy(app.Config.DuplicateLogin))
+	app.SessionManager.SetMaxSessions(app.Config.MaxUserSessions)
+
+	// 初始化路由管理器
+	app.RouterManager = NewRouterManager()
+	// 框架使用的 opcode 不能注册为路由：断开通知只由服务端发送，恢复令牌和压缩协商双向使用
+	app.RouterManager.reserve(RouteKindSend, uint16(app.Config.KickOpCode), "kick")
+	if app.Config.ResumeTimeout > 0 {
+		app.RouterManager.reserve(RouteKindHandle, uint16(app.Config.ResumeOpCode), "resume")
+		app.RouterManager.reserve(RouteKindSend, uint16(app.Config.ResumeOpCode), "resume")
+	}
+	if app.Config.Compressor != "" {
+		app.RouterManager.reserve(RouteKindHandle, uint16(app.Config.CompressOpCode), "compress")
+		app.RouterManager.reserve(RouteKindSend, uint16(app.Config.CompressOpCode), "compress")
+	}
+
+	// 初始化内置指标
+	app.metrics = newAppMetrics(app)
+}
+
+// checkRoutes 检查注册失败的路由，严格模式下 panic
+func (app *App) checkRoutes() {
+	errs := app.RouterManager.Errors()
+	if len(errs) == 0 {
+		return
+	}
+
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+		app.logger.Error("route register failed", logger.Err(err))
+	}
+	if app.Config.StrictRoute {
+		panic(errors.Wrap(ErrRouteRegister, strings.Join(msgs, "; ")))
+	}
+}
+
+// listen 创建所有监听器，所有监听器共享会话管理器和路由管理器；
+// 在 Run 中创建，使模块初始化时设置的日志等配置生效
+func (app *App) listen() {
+	for _, lc := range app.Config.ListenerConfs() {
+		l, err := app.newListener(lc)
 		if err != nil {
 			panic(err)
 		}
+		app.listeners = append(app.listeners, l)
+	}
+}
+
+// newListener 根据监听器配置创建监听器
+func (app *App) newListener(lc ListenerConf) (network.Listener, error) {
+	lF := network.NewListenerFactory(lc.NetWork, lc.Address, app.Config.ConnWriteTimeout, app.Config.ConnReadTimeout)
+	if lc.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(lc.TLS.CertFile, lc.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
 		lF.WithTlsConfig(&tls.Config{
 			Certificates: []tls.Certificate{cert},
 		})
 	}
-	if app.Config.KcpMode != "" {
-		lF.WithKcpMode(app.Config.KcpMode)
+	if lc.KcpMode != "" {
+		lF.WithKcpMode(lc.KcpMode)
 	}
-	if app.Config.WebsocketPath != "" {
-		lF.WithUpgradePath(app.Config.WebsocketPath)
+	if lc.WebsocketPath != "" {
+		lF.WithUpgradePath(lc.WebsocketPath)
 	}
-	app.listener, err = lF.Generate()
-	if err != nil {
-		panic(err)
+	if lc.PacketVersion != 0 {
+		lF.WithPacketVersion(network.PacketVersion(lc.PacketVersion))
 	}
-
-	// 初始化会话管理器
-	app.SessionManager = session.NewSessionManager()
-
-	// 初始化路由管理器
-	app.RouterManager = NewRouterManager()
+	if lc.Cipher != "" {
+		lF.WithCipher(network.Cipher(lc.Cipher))
+	}
+	if app.httpHandler != nil {
+		lF.WithHTTPHandler(app.httpHandler)
+	}
+	if app.Config.Compressor != "" {
+		c, ok := network.GetCompressor(app.Config.Compressor)
+		if !ok {
+			return nil, errors.Wrap(network.ErrCompressor, app.Config.Compressor)
+		}
+		lF.WithCompressor(c, app.Config.CompressThreshold)
+		lF.WithMaxDecompressSize(app.Config.MaxDecompressSize)
+	}
+	lF.WithLogger(app.logger.With(logger.String("network", lc.NetWork), logger.String("addr", lc.Address)))
+	lF.WithStats(app.metrics.listener(lc.NetWork))
+	return lF.Generate()
 }
 
 // Route 返回路由管理器
@@ -104,14 +201,18 @@ func (app *App) Run(modules ...Module) {
 
 		<-exitC
 		app.Destroy()
-		os.Exit(0)
 	}()
 	defer func() {
 		e := recover()
 		if e != nil {
-			fmt.Printf("panic :%v\n", e)
+			app.logger.Error("app run panic", logger.Any("panic", e))
 		}
 		app.Destroy()
+
+		// 严格路由模式下，路由注册失败需要中断启动
+		if err, ok := e.(error); ok && errors.Is(err, ErrRouteRegister) {
+			panic(e)
+		}
 	}()
 
 	// 加入模块
@@ -125,13 +226,33 @@ func (app *App) Run(modules ...Module) {
 		modulesNames += m.Name() + " "
 	}
 
-	fmt.Printf(startPanel, app.Config.NetWork, app.Config.Address, modulesNames, time.Now())
+	app.checkRoutes()
+	app.listen()
+	app.serveMetrics()
+	app.serveAdmin()
+
+	var networks, addresses string
+	for _, lc := range app.Config.ListenerConfs() {
+		networks += lc.NetWork + " "
+		addresses += lc.Address + " "
+	}
+
+	fmt.Printf(startPanel, networks, addresses, modulesNames, time.Now())
 
 	app.run()
 }
 
-// run 具体运行的逻辑
+// run 具体运行的逻辑，每个监听器独立接收连接，直到 App 退出
 func (app *App) run() {
+	for _, l := range app.listeners {
+		go app.accept(l)
+	}
+
+	<-app.exitChan
+}
+
+// accept 从监听器接收连接
+func (app *App) accept(listener network.Listener) {
 	for {
 		select {
 		case <-app.exitChan:
@@ -145,9 +266,15 @@ func (app *App) run() {
 			continue
 		}
 
-		conn, err := app.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("listener error: %v\n", err)
+			// 监听器因退出而关闭
+			select {
+			case <-app.exitChan:
+				return
+			default:
+			}
+			app.logger.Warn("listener accept failed", logger.Err(err))
 			continue
 		}
 
@@ -156,7 +283,7 @@ func (app *App) run() {
 		go func() {
 			defer func() {
 				if e := recover(); e != nil {
-					fmt.Printf("session run panic :%v\n", e)
+					app.logger.Error("session run panic", logger.String(logger.KeyRemoteIP, conn.GetRealIP()), logger.Any("panic", e))
 				}
 			}()
 
@@ -171,16 +298,73 @@ func (app *App) run() {
 			select {
 			case <-validTimer.C:
 				if !s.IsValid() {
-					s.Destroy()
+					s.Kick(session.KickReasonValidTimeout, nil)
 					return
 				}
+				// 超时的同时验证通过，UserID 已设置，验证通知随后到达
+				select {
+				case <-s.WaitValid():
+					app.onValid(s)
+				case <-s.Done():
+				}
 			case <-s.WaitValid():
-				app.SessionManager.Add(s)
+				app.onValid(s)
+			case <-s.Done():
+				// 会话已关闭，或连接已移交给恢复的会话
+			case <-app.drainChan:
+				// 未验证的会话不在会话管理器中，排空后直接踢掉
+				s.Kick(session.KickReasonShutdown, nil)
 			}
 		}()
 	}
 }
 
+// onValid 会话验证通过，开启会话恢复并加入会话管理器；重复登录策略拒绝时踢掉会话
+func (app *App) onValid(s *session.Session) {
+	if !app.SessionManager.Admit(s.GetUserID(), s.Device()) {
+		s.Kick(session.KickReasonDuplicate, nil)
+		return
+	}
+	if app.Config.ResumeTimeout > 0 {
+		resumeTimeout := time.Duration(app.Config.ResumeTimeout) * time.Second
+		if err := s.EnableResume(uint16(app.Config.ResumeOpCode), resumeTimeout, app.Config.ResumePending); err != nil {
+			app.logger.Warn("send resume token failed", append(s.LogFields(), logger.Err(err))...)
+		}
+	}
+	app.SessionManager.Add(s)
+}
+
+// SetCodec 设置默认的编解码器，路由未单独设置编解码器时使用
+func (app *App) SetCodec(c codec.Codec) {
+	app.codec = c
+}
+
+// SetLogger 设置日志，需要在 Run 之前设置，监听器在 Run 时创建
+func (app *App) SetLogger(l logger.Logger) {
+	app.logger = l
+}
+
+// SetHTTPHandler 设置 websocket 监听器处理升级路径以外请求的 Handler，需要在 Run 之前设置；
+// websocket 监听器使用独立的路由，注册在 http.DefaultServeMux 上的接口需要传入 http.DefaultServeMux 才能访问
+func (app *App) SetHTTPHandler(h http.Handler) {
+	app.httpHandler = h
+}
+
+// Logger 返回 App 使用的日志
+func (app *App) Logger() logger.Logger {
+	return app.logger
+}
+
+// Codec 返回默认的编解码器
+func (app *App) Codec() codec.Codec {
+	return app.codec
+}
+
+// SetShutdownMessage 设置关闭时通知所有会话的消息，消息需要注册为返回路由
+func (app *App) SetShutdownMessage(msg proto.Message) {
+	app.shutdownMsg = msg
+}
+
 // SetConnectEvent 设置连接事件
 func (app *App) SetConnectEvent(event SessionEvent) {
 	app.connectEvent = event
@@ -209,58 +393,244 @@ func (app *App) Call(s *session.Session, msg proto.Message) {
 	if !ok {
 		_, ok := app.RouterManager.GetSendOpCode(msgName)
 		if !ok {
-			fmt.Printf("%s\tAction Error: %v UserID: %v\n", time.Now().Format(time.RFC3339), "no register router", s.UserID)
+			app.logger.Warn("call failed", append(s.LogFields(), logger.String("msg_name", string(msgName)), logger.Err(ErrNoRegister))...)
 			return
 		}
 
 		if err := s.Send(msg); err != nil {
-			fmt.Printf("%s\tAction Send Error: %v UserID: %v\n", time.Now().Format(time.RFC3339), err, s.UserID)
+			app.logger.Warn("call send failed", append(s.LogFields(), logger.String("msg_name", string(msgName)), logger.Err(err))...)
 		}
 		return
 	}
 
-	// 内部路由执行
-	msgB, err := proto.Marshal(msg)
+	// 内部路由执行，直接使用传入的消息，不再编码和解码
+	app.dispatch(s, _r, network.PackingOpcode(_r.OpCode, nil), msg)
+}
+
+// dispatch 分发消息到处理协程，App 关闭后丢弃新消息；msg 不为空时作为请求消息，不再解码包体。
+// 客户端发送的消息超过会话的消息队列长度时，踢出会话，避免丢弃消息后请求与回复错乱
+func (app *App) dispatch(s *session.Session, r Router, p network.Packet, msg proto.Message) {
+	if err := app.tryDispatch(s, r, p, msg); err != nil {
+		p.Free()
+		app.metrics.dispatchReject.Inc()
+		app.logger.Warn("dispatch failed", append(s.LogFields(), logger.Int(logger.KeyOpCode, int(r.OpCode)), logger.Err(err))...)
+		if errors.Is(err, ErrMailboxFull) && msg == nil {
+			app.metrics.floodKicks.Inc()
+			s.Kick(session.KickReasonFlood, nil)
+		}
+	}
+}
+
+// tryDispatch 投递消息，App 关闭后丢弃新消息
+func (app *App) tryDispatch(s *session.Session, r Router, p network.Packet, msg proto.Message) error {
+	app.handleMu.RLock()
+	defer app.handleMu.RUnlock()
+	if app.closing {
+		p.Free()
+		return nil
+	}
+
+	app.handleWg.Add(1)
+	err := app.dispatcher.Dispatch(s, func() {
+		defer app.handleWg.Done()
+		app.asyncHandleMessage(s, r, p, msg)
+	})
 	if err != nil {
-		fmt.Printf("%s\tCall Marshal Error: %v UserID: %v\n", time.Now().Format(time.RFC3339), err, s.UserID)
-		return
+		app.handleWg.Done()
 	}
-	p := network.PackingOpcode(_r.OpCode, msgB)
-	go app.asyncHandleMessage(s, _r, p)
+	return err
 }
 
 // asyncHandleMessage 异步处理消息
-func (app *App) asyncHandleMessage(s *session.Session, r Router, p network.Packet) {
+func (app *App) asyncHandleMessage(s *session.Session, r Router, p network.Packet, msg proto.Message) {
 	defer func() {
 		if e := recover(); e != nil {
-			fmt.Printf("%s\tasyncHandleMessage Error: %v Opcode: %v\n", time.Now().Format(time.RFC3339), e, r.OpCode)
+			app.metrics.handlePanics.With(opcodeLabel(r.OpCode)).Inc()
+			app.logger.Error("handler panic", append(s.LogFields(), logger.Int(logger.KeyOpCode, int(r.OpCode)), logger.Any("panic", e))...)
 		}
 		p.Free()
 	}()
 
-	ctx := NewContext(context.Background(), app, s, p.OpCode(), p.Body())
-	h := r.Handler
-	// 处理消息之前，中间件过滤
-	if len(r.Middleware) > 0 {
-		for i := 0; i < len(r.Middleware); i++ {
-			h = r.Middleware[i](h)
+	ctx := NewContext(context.Background(), app, s, p, app.routeCodec(r)).(*DefaultContext)
+	if msg != nil {
+		ctx.SetMessage(msg)
+	} else if r.Message != nil {
+		// 按注册的类型解码请求消息，在中间件之后、Handler 之前，或第一次读取消息时解码，只解码一次
+		ctx.decoder = func() (proto.Message, error) {
+			return app.decode(ctx, r, p)
+		}
+	}
+
+	// 处理消息之前，中间件过滤：路由的中间件后注册的在外层，全局中间件在路由的中间件之外，解码在最内层
+	h := decodeHandler(r.Handler)
+	for i := 0; i < len(r.Middleware); i++ {
+		h = r.Middleware[i](h)
+	}
+	h = chainMiddleware(h, app.middleware)
+	// 处理消息，记录耗时
+	start := time.Now()
+	err := h(ctx)
+	app.metrics.handleDuration.With(opcodeLabel(r.OpCode)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		app.metrics.handleErrors.With(opcodeLabel(r.OpCode)).Inc()
+		app.handleError(ctx, r, err)
+	}
+}
+
+// decodeHandler 在 Handler 之前解码请求消息，解码或校验失败时不执行 Handler
+func decodeHandler(h Handler) Handler {
+	return func(ctx Context) error {
+		if err := loadMessage(ctx); err != nil {
+			return err
 		}
+		return h(ctx)
 	}
-	// 处理消息
-	if err := h(ctx); err != nil {
-		fmt.Printf("%s\tOnMessage Error: %v Opcode: %v\n", time.Now().Format(time.RFC3339), err, r.OpCode)
+}
+
+// loadMessage 解码请求消息，已解码时返回之前的结果
+func loadMessage(ctx Context) error {
+	if c, ok := ctx.(*DefaultContext); ok {
+		return c.loadMessage()
+	}
+	return nil
+}
+
+// decode 解码请求消息，消息实现 Validator 时进行校验
+func (app *App) decode(ctx Context, r Router, p network.Packet) (proto.Message, error) {
+	msg := r.Message.New().Interface()
+	if err := ctx.Codec().Unmarshal(p.Body(), msg); err != nil {
+		return nil, errors.Wrapf(ErrDecode, "%s: %v", r.Name, err)
+	}
+
+	if v, ok := msg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, errors.Wrapf(ErrValidate, "%s: %v", r.Name, err)
+		}
+	}
+	return msg, nil
+}
+
+// handleError 处理请求的错误；未设置错误处理函数时，记录日志并向外部路由的请求回复错误
+func (app *App) handleError(ctx Context, r Router, err error) {
+	if app.errorHandler != nil {
+		app.errorHandler(ctx, err)
 		return
 	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		app.logger.Debug("request failed", append(ctx.Session().LogFields(), logger.Int(logger.KeyOpCode, int(ctx.GetOpCode())), logger.Err(err))...)
+	} else {
+		app.logger.Warn("request failed", append(ctx.Session().LogFields(), logger.Int(logger.KeyOpCode, int(ctx.GetOpCode())), logger.Err(err))...)
+	}
+
+	// 内部路由的错误没有对应的客户端请求
+	if r.Kind == RouteKindHandle {
+		if rerr := app.ReplyError(ctx, err); rerr != nil {
+			app.logger.Warn("reply error failed", append(ctx.Session().LogFields(), logger.Int(logger.KeyOpCode, int(ctx.GetOpCode())), logger.Err(rerr))...)
+		}
+	}
 }
 
-// Destroy 销毁 App
+// ReplyError 使用 ErrorOpCode 向请求的会话回复错误，回复携带请求的序列号；
+// 未使用 Error 的错误会被屏蔽为 CodeInternal，避免泄露内部信息。未配置 ErrorOpCode 时不回复
+func (app *App) ReplyError(ctx Context, err error) error {
+	if app.Config.ErrorOpCode <= 0 {
+		return nil
+	}
+
+	body := toError(err).marshal()
+	opcode := uint16(app.Config.ErrorOpCode)
+	if seq := ctx.Seq(); seq != 0 {
+		return ctx.Session().WritePacket(network.PackingSeqOpcode(opcode, seq, body))
+	}
+	return ctx.Session().WritePacket(network.PackingOpcode(opcode, body))
+}
+
+// Use 添加全局中间件，作用于所有外部路由和内部路由，包括 Use 之前注册的路由；
+// 全局中间件在路由的中间件之外执行，先添加的在外层。需要在 Run 之前调用
+func (app *App) Use(middleware ...Middleware) {
+	app.middleware = append(app.middleware, middleware...)
+}
+
+// SetErrorHandler 设置错误处理函数，请求解码、校验失败或 Handler 返回错误时调用
+func (app *App) SetErrorHandler(h ErrorHandler) {
+	app.errorHandler = h
+}
+
+// routeCodec 获取路由使用的编解码器
+func (app *App) routeCodec(r Router) codec.Codec {
+	if r.Codec != nil {
+		return r.Codec
+	}
+	return app.codec
+}
+
+// Destroy 销毁 App；依次停止接收新连接，通知所有会话，等待处理中的消息，
+// 最后销毁会话和模块
 func (app *App) Destroy() {
 	app.exitOnce.Do(func() {
-		// 先销毁模块，倒序销毁
+		// 停止接收新连接
+		close(app.exitChan)
+		for _, l := range app.listeners {
+			l.Close()
+		}
+
+		// 不再处理新的消息
+		app.handleMu.Lock()
+		app.closing = true
+		app.handleMu.Unlock()
+
+		// 通知所有会话服务器即将关闭
+		if app.shutdownMsg != nil {
+			app.SessionManager.Range(func(s *session.Session) bool {
+				if err := s.Send(app.shutdownMsg); err != nil {
+					app.logger.Warn("send shutdown message failed", append(s.LogFields(), logger.Err(err))...)
+				}
+				return true
+			})
+		}
+
+		// 等待处理中的消息，最多等待 ShutdownTimeout
+		app.waitHandle(time.Duration(app.Config.ShutdownTimeout) * time.Second)
+		app.dispatcher.Close()
+		close(app.drainChan)
+
+		// 销毁所有会话
+		app.SessionManager.Close()
+
+		// 销毁模块，倒序销毁
 		for i := len(app.modules) - 1; i >= 0; i-- {
 			app.modules[i].OnDestroy()
 		}
-		close(app.exitChan)
-		app.listener.Close()
+
+		if app.metricsServer != nil {
+			app.metricsServer.Close()
+		}
+		if app.adminServer != nil {
+			app.adminServer.Close()
+		}
 	})
 }
+
+// waitHandle 等待处理中的消息完成，timeout 小于等于 0 时不等待
+func (app *App) waitHandle(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		app.handleWg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		app.logger.Warn("shutdown timeout, handlers still running", logger.String("timeout", timeout.String()))
+	}
+}
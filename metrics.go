@@ -0,0 +1,128 @@
+package lulu
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/trainking/lulu/logger"
+	"github.com/trainking/lulu/metrics"
+)
+
+type (
+	// appMetrics 框架内置的指标
+	appMetrics struct {
+		registry        *metrics.Registry
+		handleDuration  *metrics.HistogramVec // 处理器耗时
+		handleErrors    *metrics.CounterVec   // 处理器返回的错误
+		handlePanics    *metrics.CounterVec   // 处理器 panic
+		unknownOpCodes  *metrics.Counter      // 未注册的 opcode
+		dispatchReject  *metrics.Counter      // 分发被拒绝的消息
+		floodKicks      *metrics.Counter      // 洪水攻击踢出
+		packetsReceived *metrics.CounterVec   // 接收的报文数
+		packetsSent     *metrics.CounterVec   // 发送的报文数
+		bytesReceived   *metrics.CounterVec   // 接收的字节数
+		bytesSent       *metrics.CounterVec   // 发送的字节数
+		compressRaw     *metrics.CounterVec   // 压缩前的包体字节数
+		compressOut     *metrics.CounterVec   // 压缩后的包体字节数
+	}
+
+	// listenerStats 单个监听器的流量统计
+	listenerStats struct {
+		packetsReceived *metrics.Counter
+		packetsSent     *metrics.Counter
+		bytesReceived   *metrics.Counter
+		bytesSent       *metrics.Counter
+		compressRaw     *metrics.Counter
+		compressOut     *metrics.Counter
+	}
+)
+
+// newAppMetrics 注册框架内置的指标
+func newAppMetrics(app *App) *appMetrics {
+	r := metrics.NewRegistry()
+
+	r.NewGaugeFunc("lulu_connections", "Current number of connections.", func() float64 {
+		return float64(atomic.LoadInt32(&app.connCount))
+	})
+	r.NewGaugeFunc("lulu_sessions", "Current number of valid sessions.", func() float64 {
+		return float64(app.SessionManager.Len())
+	})
+
+	return &appMetrics{
+		registry:        r,
+		handleDuration:  r.NewHistogramVec("lulu_handler_duration_seconds", "Handler latency by opcode.", nil, "opcode"),
+		handleErrors:    r.NewCounterVec("lulu_handler_errors_total", "Handler errors by opcode.", "opcode"),
+		handlePanics:    r.NewCounterVec("lulu_handler_panics_total", "Handler panics by opcode.", "opcode"),
+		unknownOpCodes:  r.NewCounter("lulu_unknown_opcode_total", "Received packets without a registered route."),
+		dispatchReject:  r.NewCounter("lulu_dispatch_rejected_total", "Messages dropped because the dispatch queue was full."),
+		floodKicks:      r.NewCounter("lulu_flood_kicks_total", "Sessions kicked for exceeding HeartLimit or a full session mailbox."),
+		packetsReceived: r.NewCounterVec("lulu_packets_received_total", "Packets received by network.", "network"),
+		packetsSent:     r.NewCounterVec("lulu_packets_sent_total", "Packets sent by network.", "network"),
+		bytesReceived:   r.NewCounterVec("lulu_bytes_received_total", "Bytes received by network.", "network"),
+		bytesSent:       r.NewCounterVec("lulu_bytes_sent_total", "Bytes sent by network.", "network"),
+		compressRaw:     r.NewCounterVec("lulu_compress_raw_bytes_total", "Packet body bytes before compression by network.", "network"),
+		compressOut:     r.NewCounterVec("lulu_compress_bytes_total", "Packet body bytes after compression by network.", "network"),
+	}
+}
+
+// listener 返回监听器的流量统计
+func (m *appMetrics) listener(network string) *listenerStats {
+	return &listenerStats{
+		packetsReceived: m.packetsReceived.With(network),
+		packetsSent:     m.packetsSent.With(network),
+		bytesReceived:   m.bytesReceived.With(network),
+		bytesSent:       m.bytesSent.With(network),
+		compressRaw:     m.compressRaw.With(network),
+		compressOut:     m.compressOut.With(network),
+	}
+}
+
+func (l *listenerStats) OnRead(n int) {
+	l.packetsReceived.Inc()
+	l.bytesReceived.Add(float64(n))
+}
+
+func (l *listenerStats) OnWrite(n int) {
+	l.packetsSent.Inc()
+	l.bytesSent.Add(float64(n))
+}
+
+func (l *listenerStats) OnCompress(raw, compressed int) {
+	l.compressRaw.Add(float64(raw))
+	l.compressOut.Add(float64(compressed))
+}
+
+// opcodeLabel opcode 的标签值
+func opcodeLabel(opcode uint16) string {
+	return strconv.Itoa(int(opcode))
+}
+
+// Metrics 返回指标注册表，可以注册业务自己的指标，和框架指标一起输出
+func (app *App) Metrics() *metrics.Registry {
+	return app.metrics.registry
+}
+
+// serveMetrics 配置了 MetricsAddress 时，启动指标的 HTTP 服务
+func (app *App) serveMetrics() {
+	if app.Config.MetricsAddress == "" {
+		return
+	}
+
+	path := app.Config.MetricsPath
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, app.metrics.registry.Handler())
+
+	app.metricsServer = &http.Server{
+		Addr:    app.Config.MetricsAddress,
+		Handler: mux,
+	}
+	go func() {
+		if err := app.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			app.logger.Error("metrics server failed", logger.String("addr", app.Config.MetricsAddress), logger.Err(err))
+		}
+	}()
+}
@@ -0,0 +1,375 @@
+/*
+metrics 提供计数器、仪表盘和直方图，并以 Prometheus 文本格式输出，不依赖外部库。
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefaultBuckets 默认的直方图分桶，单位为秒
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type (
+	// Registry 指标注册表，按注册顺序输出
+	Registry struct {
+		families []*family
+		names    map[string]struct{}
+		mu       sync.RWMutex
+	}
+
+	// family 同名指标的集合，不同的标签值对应不同的序列
+	family struct {
+		name    string
+		help    string
+		typ     string
+		labels  []string
+		buckets []float64
+		fn      func() float64 // 仪表盘函数，读取时求值
+		series  map[string]*series
+		mu      sync.RWMutex
+	}
+
+	// series 一组标签值对应的序列
+	series struct {
+		values []string
+		value  uint64   // 计数器和仪表盘的值，float64 的位表示
+		counts []uint64 // 直方图各分桶的计数
+		count  uint64   // 直方图的观测次数
+		sum    uint64   // 直方图的观测总和，float64 的位表示
+	}
+
+	// Counter 只增不减的计数器
+	Counter struct {
+		s *series
+	}
+
+	// Gauge 可增可减的仪表盘
+	Gauge struct {
+		s *series
+	}
+
+	// Histogram 直方图，统计观测值的分布
+	Histogram struct {
+		s       *series
+		buckets []float64
+	}
+
+	// CounterVec 带标签的计数器
+	CounterVec struct {
+		f *family
+	}
+
+	// GaugeVec 带标签的仪表盘
+	GaugeVec struct {
+		f *family
+	}
+
+	// HistogramVec 带标签的直方图
+	HistogramVec struct {
+		f *family
+	}
+)
+
+// NewRegistry 创建指标注册表
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+// register 注册指标，名字重复时 panic
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[f.name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", f.name))
+	}
+	r.names[f.name] = struct{}{}
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// NewCounter 注册计数器
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// NewCounterVec 注册带标签的计数器
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(&family{name: name, help: help, typ: typeCounter, labels: labels})}
+}
+
+// NewGauge 注册仪表盘
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// NewGaugeVec 注册带标签的仪表盘
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(&family{name: name, help: help, typ: typeGauge, labels: labels})}
+}
+
+// NewGaugeFunc 注册仪表盘，每次输出时调用 fn 取值
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, typ: typeGauge, fn: fn})
+}
+
+// NewHistogram 注册直方图，buckets 为空时使用 DefaultBuckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// NewHistogramVec 注册带标签的直方图，buckets 为空时使用 DefaultBuckets
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: r.register(&family{name: name, help: help, typ: typeHistogram, labels: labels, buckets: buckets})}
+}
+
+// with 获取标签值对应的序列，不存在时创建
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok = f.series[key]; ok {
+		return s
+	}
+	s = &series{values: append([]string(nil), values...)}
+	if f.typ == typeHistogram {
+		s.counts = make([]uint64, len(f.buckets))
+	}
+	f.series[key] = s
+	return s
+}
+
+// With 获取标签值对应的计数器
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{s: v.f.with(values)}
+}
+
+// With 获取标签值对应的仪表盘
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{s: v.f.with(values)}
+}
+
+// With 获取标签值对应的直方图
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{s: v.f.with(values), buckets: v.f.buckets}
+}
+
+// Inc 加一
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add 增加 delta，delta 不能为负数
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	addFloat(&c.s.value, delta)
+}
+
+// Value 当前的值
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.s.value))
+}
+
+// Set 设置值
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.s.value, math.Float64bits(v))
+}
+
+// Add 增加 delta，可以为负数
+func (g *Gauge) Add(delta float64) {
+	addFloat(&g.s.value, delta)
+}
+
+// Value 当前的值
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.s.value))
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.s.counts[i], 1)
+	}
+	atomic.AddUint64(&h.s.count, 1)
+	addFloat(&h.s.sum, v)
+}
+
+// addFloat 原子地为 float64 的位表示增加 delta
+func addFloat(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		nv := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(addr, old, nv) {
+			return
+		}
+	}
+}
+
+// WriteTo 以 Prometheus 文本格式输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	families := append([]*family(nil), r.families...)
+	r.mu.RUnlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// Handler 返回输出指标的 http.Handler
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// write 输出一个指标的所有序列，序列按标签值排序
+func (f *family) write(w *countWriter) {
+	w.printf("# HELP %s %s\n", f.name, escapeHelp(f.help))
+	w.printf("# TYPE %s %s\n", f.name, f.typ)
+
+	if f.fn != nil {
+		w.printf("%s %s\n", f.name, formatFloat(f.fn()))
+		return
+	}
+
+	f.mu.RLock()
+	list := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		list = append(list, s)
+	}
+	f.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+	})
+
+	for _, s := range list {
+		labels := formatLabels(f.labels, s.values, "", "")
+		if f.typ != typeHistogram {
+			w.printf("%s%s %s\n", f.name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&s.value))))
+			continue
+		}
+
+		var cumulative uint64
+		for i, b := range f.buckets {
+			cumulative += atomic.LoadUint64(&s.counts[i])
+			w.printf("%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", formatFloat(b)), cumulative)
+		}
+		count := atomic.LoadUint64(&s.count)
+		w.printf("%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", "+Inf"), count)
+		w.printf("%s_sum%s %s\n", f.name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&s.sum))))
+		w.printf("%s_count%s %d\n", f.name, labels, count)
+	}
+}
+
+// formatLabels 输出 {name="value",...}，extra 不为空时追加在最后
+func formatLabels(names, values []string, extra, extraValue string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatFloat 按 Prometheus 的格式输出浮点数
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+// countWriter 记录写入的字节数和第一个错误
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
@@ -1,8 +1,48 @@
 package lulu
 
+import (
+	"context"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trainking/lulu/logger"
+)
+
 // Mideeleware 中间件定义
 type Middleware func(next Handler) Handler
 
+// PanicHandler panic 回调，e 为 panic 的值，stack 为发生 panic 时的调用栈
+type PanicHandler func(ctx Context, e interface{}, stack []byte)
+
+type (
+	// rateLimiter 一个会话的限流器，每个 opcode 一个令牌桶
+	rateLimiter struct {
+		buckets map[uint16]*tokenBucket
+		mu      sync.Mutex
+	}
+
+	// tokenBucket 令牌桶
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+// rateLimitID 区分不同的限流中间件，各自使用独立的会话属性
+var rateLimitID int64
+
+// chainMiddleware 将全局中间件包装在 h 之外，middleware[0] 在最外层，最先执行
+func chainMiddleware(h Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
 // MiddlewareValidSession 验证会话有效的中间件
 func MiddlewareValidSession() Middleware {
 	return func(next Handler) Handler {
@@ -14,3 +54,107 @@ func MiddlewareValidSession() Middleware {
 		}
 	}
 }
+
+// MiddlewareRecovery 恢复 Handler 的 panic 并转换为 ErrPanic 错误；
+// onPanic 可以获取调用栈，为空时记录错误日志
+func MiddlewareRecovery(onPanic PanicHandler) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx Context) (err error) {
+			defer func() {
+				if e := recover(); e != nil {
+					stack := debug.Stack()
+					if onPanic != nil {
+						onPanic(ctx, e, stack)
+					} else {
+						ctx.App().Logger().Error("handler panic", append(ctx.Session().LogFields(),
+							logger.Int(logger.KeyOpCode, int(ctx.GetOpCode())),
+							logger.Any("panic", e),
+							logger.String("stack", string(stack)),
+						)...)
+					}
+					err = errors.Wrapf(ErrPanic, "%v", e)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// MiddlewareTimeout 为 Handler 设置处理时限，超时后 ctx.Context() 被取消；
+// Handler 仍在当前协程中执行，需要自行监听 ctx.Context().Done() 并尽快返回
+func MiddlewareTimeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx Context) error {
+			parent := ctx.Context()
+			c, cancel := context.WithTimeout(parent, timeout)
+			defer cancel()
+
+			ctx.SetContext(c)
+			defer ctx.SetContext(parent)
+			return next(ctx)
+		}
+	}
+}
+
+// MiddlewareRateLimit 按会话和 opcode 限制请求频率的令牌桶，每秒补充 rate 个令牌，最多积累 burst 个；
+// 超过限制时返回 ErrRateLimited。令牌桶保存在会话属性中，会话销毁时清除
+func MiddlewareRateLimit(rate float64, burst int) Middleware {
+	key := "lulu.ratelimit." + strconv.FormatInt(atomic.AddInt64(&rateLimitID, 1), 10)
+
+	return func(next Handler) Handler {
+		return func(ctx Context) error {
+			v, _ := ctx.Session().LoadOrStore(key, &rateLimiter{buckets: make(map[uint16]*tokenBucket)})
+			if !v.(*rateLimiter).allow(ctx.GetOpCode(), rate, burst) {
+				return ErrRateLimited
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// MiddlewareLogger 记录每个请求的 opcode、耗时和错误；成功的请求使用 Info 级别，失败的请求使用 Warn 级别
+func MiddlewareLogger() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx Context) error {
+			start := time.Now()
+			err := next(ctx)
+
+			fields := append(ctx.Session().LogFields(),
+				logger.Int(logger.KeyOpCode, int(ctx.GetOpCode())),
+				logger.String("duration", time.Since(start).String()),
+			)
+			if err != nil {
+				ctx.App().Logger().Warn("request", append(fields, logger.Err(err))...)
+			} else {
+				ctx.App().Logger().Info("request", fields...)
+			}
+			return err
+		}
+	}
+}
+
+// allow 从 opcode 的令牌桶中取一个令牌
+func (l *rateLimiter) allow(opcode uint16, rate float64, burst int) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[opcode]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[opcode] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,380 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	FlateName  = "flate"
+	ZlibName   = "zlib"
+	SnappyName = "snappy"
+)
+
+const (
+	// DefaultCompressThreshold 默认的压缩阈值，包体小于阈值时不压缩
+	DefaultCompressThreshold = 1024
+
+	// DefaultMaxDecompressSize 默认的解压后包体的最大字节数
+	DefaultMaxDecompressSize = 1 << 20
+
+	packetCompressLen = 1 // 压缩算法编号的长度
+
+	// snappyMaxExpand snappy 块格式的最大膨胀倍数，3 字节的复制元素最多展开为 64 字节
+	snappyMaxExpand = 22
+)
+
+var (
+	// Flate DEFLATE 压缩，压缩率较高
+	Flate Compressor = flateCompressor{}
+
+	// Zlib zlib 压缩，DEFLATE 加上校验和，便于其他语言的客户端实现
+	Zlib Compressor = zlibCompressor{}
+
+	// Snappy snappy 块格式压缩（github.com/golang/snappy），速度快，压缩率较低
+	Snappy Compressor = snappyCompressor{}
+
+	compressors     = map[uint8]Compressor{}
+	compressorNames = map[string]Compressor{}
+	compressorsMu   sync.RWMutex
+)
+
+type (
+	// Compressor 报文压缩算法
+	Compressor interface {
+		// ID 压缩算法的编号，写入压缩报文的报文头，1-255
+		ID() uint8
+
+		// Name 压缩算法的名字，与配置中的 Compressor 对应
+		Name() string
+
+		// Compress 压缩包体
+		Compress(src []byte) ([]byte, error)
+
+		// Decompress 解压包体，解压后超过 limit 时返回 ErrPacketTooLarge
+		Decompress(src []byte, limit int) ([]byte, error)
+	}
+
+	// CompressStats 压缩的统计，Config.Stats 实现此接口时统计压缩前后的包体大小
+	CompressStats interface {
+		// OnCompress 压缩了一个报文，raw 为压缩前的包体字节数，compressed 为压缩后的字节数
+		OnCompress(raw, compressed int)
+	}
+
+	// CompressConn 可以协商压缩算法的连接，tcp、kcp 和 websocket 的连接都实现了此接口；
+	// 协商分为两步，先接受压缩的报文，回复对端之后再压缩发送的报文，避免对端收到回复之前就收到压缩的报文
+	CompressConn interface {
+		// AcceptCompressor 协商连接的压缩算法，ids 为对端支持的压缩算法编号；本端配置的压缩算法在 ids 中，
+		// 并且使用 V2 报文头时，连接之后接受此算法压缩的报文，返回此算法；否则不接受压缩的报文，返回 nil
+		AcceptCompressor(ids []byte) Compressor
+
+		// ActivateCompressor 之后发送的报文使用 AcceptCompressor 协商的算法压缩
+		ActivateCompressor()
+	}
+
+	// compression 连接协商后的压缩算法，协商之前不压缩，也不接受压缩的报文
+	compression struct {
+		in  atomic.Value // compressorBox，接受的压缩算法
+		out atomic.Value // compressorBox，发送使用的压缩算法
+	}
+
+	// compressorBox atomic.Value 不能保存 nil，使用结构体包装
+	compressorBox struct {
+		c Compressor
+	}
+
+	// BroadcastPacket 广播的报文，发送给多个连接时，每种压缩算法只压缩一次
+	BroadcastPacket struct {
+		Packet
+		compressed map[uint8]compressResult // 压缩的结果，key：压缩算法编号
+		mu         sync.Mutex
+	}
+
+	// compressResult 包体压缩的结果，ok 为 false 时压缩失败或没有变小
+	compressResult struct {
+		body []byte
+		ok   bool
+	}
+
+	flateCompressor struct{}
+
+	zlibCompressor struct{}
+
+	snappyCompressor struct{}
+)
+
+func init() {
+	RegisterCompressor(Flate)
+	RegisterCompressor(Zlib)
+	RegisterCompressor(Snappy)
+}
+
+// RegisterCompressor 注册压缩算法，同编号或同名会覆盖；收到的压缩报文按编号查找解压算法
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.ID()] = c
+	compressorNames[c.Name()] = c
+}
+
+// GetCompressor 通过名字获取压缩算法
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressorNames[name]
+	return c, ok
+}
+
+// getCompressor 通过编号获取压缩算法
+func getCompressor(id uint8) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[id]
+	return c, ok
+}
+
+func (flateCompressor) ID() uint8 {
+	return 1
+}
+
+func (flateCompressor) Name() string {
+	return FlateName
+}
+
+func (flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return compressWrite(&buf, w, src)
+}
+
+func (flateCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return decompressRead(r, limit)
+}
+
+func (zlibCompressor) ID() uint8 {
+	return 2
+}
+
+func (zlibCompressor) Name() string {
+	return ZlibName
+}
+
+func (zlibCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return compressWrite(&buf, zlib.NewWriter(&buf), src)
+}
+
+func (zlibCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return decompressRead(r, limit)
+}
+
+func (snappyCompressor) ID() uint8 {
+	return 3
+}
+
+func (snappyCompressor) Name() string {
+	return SnappyName
+}
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+// Decompress 先检查包体声明的解压后长度，超过 limit 或超过包体可能展开的长度时不分配内存
+func (snappyCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, ErrCompressCorrupt
+	}
+	if n > limit {
+		return nil, ErrPacketTooLarge
+	}
+	if n > len(src)*snappyMaxExpand {
+		return nil, ErrCompressCorrupt
+	}
+	b, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, ErrCompressCorrupt
+	}
+	return b, nil
+}
+
+// CompressOffer 协商压缩时本端支持的压缩算法编号，本端未配置压缩算法或不使用 V2 报文头时为空
+func CompressOffer(c *Config) []byte {
+	if c.Compressor == nil || c.Version() != PacketV2 {
+		return nil
+	}
+	return []byte{c.Compressor.ID()}
+}
+
+// NewBroadcastPacket 包装广播的报文，各个连接发送时共享压缩的结果
+func NewBroadcastPacket(p Packet) *BroadcastPacket {
+	return &BroadcastPacket{Packet: p, compressed: make(map[uint8]compressResult)}
+}
+
+// compress 使用 comp 压缩包体，同一压缩算法只压缩一次
+func (p *BroadcastPacket) compress(body []byte, comp Compressor) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.compressed[comp.ID()]
+	if !ok {
+		r.body, r.ok = compressBody(body, comp)
+		p.compressed[comp.ID()] = r
+	}
+	return r.body, r.ok
+}
+
+// compressBody 使用 comp 压缩包体，压缩失败或没有变小时返回 false
+func compressBody(body []byte, comp Compressor) ([]byte, bool) {
+	compressed, err := comp.Compress(body)
+	if err != nil || len(compressed)+packetCompressLen >= len(body) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+// inbound 返回接受的压缩算法，未协商时为 nil
+func (c *compression) inbound() Compressor {
+	if b, ok := c.in.Load().(compressorBox); ok {
+		return b.c
+	}
+	return nil
+}
+
+// outbound 返回发送使用的压缩算法，未启用时为 nil
+func (c *compression) outbound() Compressor {
+	if b, ok := c.out.Load().(compressorBox); ok {
+		return b.c
+	}
+	return nil
+}
+
+// accept 按对端支持的压缩算法编号协商，之后接受协商的压缩算法，返回此算法
+func (c *compression) accept(config *Config, ids []byte) Compressor {
+	var comp Compressor
+	if offer := CompressOffer(config); len(offer) > 0 && bytes.IndexByte(ids, offer[0]) >= 0 {
+		comp = config.Compressor
+	}
+	c.in.Store(compressorBox{comp})
+	return comp
+}
+
+// activate 发送的报文开始使用协商的压缩算法
+func (c *compression) activate() {
+	c.out.Store(compressorBox{c.inbound()})
+}
+
+// compressWrite 使用流式压缩写入 src，返回压缩后的数据
+func compressWrite(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressRead 读取流式解压的数据，超过 limit 时返回 ErrPacketTooLarge，防止压缩炸弹
+func decompressRead(r io.Reader, limit int) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, ErrPacketTooLarge
+	}
+	return b, nil
+}
+
+// compress V2 报文的包体不小于阈值时，使用连接协商的压缩算法 comp 压缩；压缩后没有变小时发送原报文。
+// b 为 p 序列化后的数据，可能是 p 持有的数据，压缩时总是生成新的报文；p 为 BroadcastPacket 时共享压缩的结果
+func (c *Config) compress(p Packet, b []byte, comp Compressor) []byte {
+	if comp == nil || c.Version() != PacketV2 {
+		return b
+	}
+
+	flag := b[0]
+	if flag&FlagCompress != 0 {
+		return b
+	}
+	headLen := packetV2HeadLen
+	if flag&FlagSeq != 0 {
+		headLen += packetSeqLen
+	}
+	body := b[headLen:]
+	threshold := c.CompressThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	if len(body) < threshold {
+		return b
+	}
+
+	var compressed []byte
+	var ok bool
+	if bp, isBroadcast := p.(*BroadcastPacket); isBroadcast {
+		compressed, ok = bp.compress(body, comp)
+	} else {
+		compressed, ok = compressBody(body, comp)
+	}
+	if !ok {
+		return b
+	}
+	if s, ok := c.Stats.(CompressStats); ok {
+		s.OnCompress(len(body), len(compressed))
+	}
+
+	buff := make([]byte, headLen+packetCompressLen+len(compressed))
+	copy(buff, b[:headLen])
+	buff[0] |= FlagCompress
+	binary.BigEndian.PutUint32(buff[1:5], uint32(len(compressed)))
+	buff[headLen] = comp.ID()
+	copy(buff[headLen+packetCompressLen:], compressed)
+	return buff
+}
+
+// decompress 解压带有 FlagCompress 的报文，返回不带压缩标志的新报文；
+// 只接受连接协商的压缩算法 comp，未协商压缩时收到压缩报文返回 ErrCompressor
+func (c *Config) decompress(p Packet, comp Compressor) (Packet, error) {
+	dp, ok := p.(*DefaultPacket)
+	if !ok || dp.flag()&FlagCompress == 0 {
+		return p, nil
+	}
+
+	headLen := dp.headLen()
+	if comp == nil || dp.buff[headLen-packetCompressLen] != comp.ID() {
+		dp.Free()
+		return nil, ErrCompressor
+	}
+	limit := c.MaxDecompressSize
+	if limit <= 0 {
+		limit = DefaultMaxDecompressSize
+	}
+	body, err := comp.Decompress(dp.Body(), limit)
+	if err != nil {
+		dp.Free()
+		return nil, err
+	}
+
+	np := NewDefaultPacket(PacketV2, packingBuff(PacketV2, dp.OpCode(), dp.Seq(), body))
+	dp.Free()
+	return np, nil
+}
@@ -0,0 +1,176 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("lulu compress "), 100)
+	for _, c := range []Compressor{Flate, Zlib, Snappy} {
+		t.Run(c.Name(), func(t *testing.T) {
+			compressed, err := c.Compress(body)
+			if err != nil {
+				t.Fatalf("Compress: %v", err)
+			}
+			got, err := c.Decompress(compressed, len(body))
+			if err != nil {
+				t.Fatalf("Decompress: %v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Fatal("body mismatch")
+			}
+
+			// 解压后超过上限
+			if _, err := c.Decompress(compressed, len(body)-1); !errors.Is(err, ErrPacketTooLarge) {
+				t.Fatalf("limit: got %v, want ErrPacketTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	// 16MB 的 0 压缩后只有几十 KB，解压时必须在上限处停止
+	bomb := make([]byte, 16<<20)
+	for _, c := range []Compressor{Flate, Zlib, Snappy} {
+		t.Run(c.Name(), func(t *testing.T) {
+			compressed, err := c.Compress(bomb)
+			if err != nil {
+				t.Fatalf("Compress: %v", err)
+			}
+			if len(compressed) > MaxPacketSize {
+				t.Skipf("compressed bomb %d bytes exceeds MaxPacketSize", len(compressed))
+			}
+			if _, err := c.Decompress(compressed, DefaultMaxDecompressSize); !errors.Is(err, ErrPacketTooLarge) {
+				t.Fatalf("got %v, want ErrPacketTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestSnappyDeclaredLength(t *testing.T) {
+	// 声明的长度远大于包体能够展开的长度，不分配内存直接拒绝
+	src := snappy.Encode(nil, []byte("abc"))
+	forged := append([]byte{0xFF, 0xFF, 0x3F}, src[1:]...) // 约 1MB 的声明长度
+	if _, err := Snappy.Decompress(forged, 4<<20); !errors.Is(err, ErrCompressCorrupt) {
+		t.Fatalf("got %v, want ErrCompressCorrupt", err)
+	}
+	if _, err := Snappy.Decompress([]byte{0xFF}, 1<<20); !errors.Is(err, ErrCompressCorrupt) {
+		t.Fatalf("corrupt: got %v, want ErrCompressCorrupt", err)
+	}
+}
+
+func TestConfigCompress(t *testing.T) {
+	config := &Config{PacketVersion: PacketV2, Compressor: Snappy, CompressThreshold: 16}
+	body := bytes.Repeat([]byte("a"), 1024)
+
+	for _, seq := range []uint32{0, 9} {
+		p := PackingSeqOpcode(100, seq, body)
+		b, err := SerializeVersion(p, PacketV2)
+		if err != nil {
+			t.Fatalf("SerializeVersion: %v", err)
+		}
+		cb := config.compress(p, b, Snappy)
+		if len(cb) >= len(b) || cb[0]&FlagCompress == 0 {
+			t.Fatalf("seq %d: packet not compressed", seq)
+		}
+
+		cp, err := PackingBytes(cb, PacketV2)
+		if err != nil {
+			t.Fatalf("PackingBytes: %v", err)
+		}
+		got, err := config.decompress(cp, Snappy)
+		if err != nil {
+			t.Fatalf("decompress: %v", err)
+		}
+		if got.OpCode() != 100 || got.Seq() != seq || !bytes.Equal(got.Body(), body) {
+			t.Fatalf("seq %d: got opcode %d seq %d body %d bytes", seq, got.OpCode(), got.Seq(), len(got.Body()))
+		}
+	}
+
+	// 小于阈值的包体和 V1 报文头不压缩
+	small := PackingSeqOpcode(100, 0, []byte("tiny"))
+	b, _ := SerializeVersion(small, PacketV2)
+	if cb := config.compress(small, b, Snappy); !bytes.Equal(cb, b) {
+		t.Fatal("small body compressed")
+	}
+	v1 := &Config{PacketVersion: PacketV1, Compressor: Snappy}
+	p := PackingOpcode(100, body)
+	b, _ = SerializeVersion(p, PacketV1)
+	if cb := v1.compress(p, b, Snappy); !bytes.Equal(cb, b) {
+		t.Fatal("v1 packet compressed")
+	}
+}
+
+func TestConfigDecompressRejects(t *testing.T) {
+	config := &Config{PacketVersion: PacketV2, Compressor: Snappy, MaxDecompressSize: 1024}
+	body := bytes.Repeat([]byte("a"), 4096)
+	p := PackingVersionOpcode(PacketV2, 1, body)
+	b, _ := SerializeVersion(p, PacketV2)
+	cb := config.compress(p, b, Snappy)
+
+	parse := func() Packet {
+		cp, err := PackingBytes(append([]byte(nil), cb...), PacketV2)
+		if err != nil {
+			t.Fatalf("PackingBytes: %v", err)
+		}
+		return cp
+	}
+
+	// 未协商压缩的连接不接受压缩报文
+	if _, err := config.decompress(parse(), nil); !errors.Is(err, ErrCompressor) {
+		t.Fatalf("not negotiated: got %v, want ErrCompressor", err)
+	}
+	// 与协商的算法不一致
+	if _, err := config.decompress(parse(), Flate); !errors.Is(err, ErrCompressor) {
+		t.Fatalf("mismatch: got %v, want ErrCompressor", err)
+	}
+	// 解压后超过 MaxDecompressSize
+	if _, err := config.decompress(parse(), Snappy); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("limit: got %v, want ErrPacketTooLarge", err)
+	}
+}
+
+func TestCompressionNegotiate(t *testing.T) {
+	config := &Config{PacketVersion: PacketV2, Compressor: Zlib}
+
+	var c compression
+	if c.accept(config, []byte{Flate.ID(), Snappy.ID()}) != nil {
+		t.Fatal("accepted an algorithm the server does not use")
+	}
+	if c.accept(config, []byte{Flate.ID(), Zlib.ID()}) != Zlib {
+		t.Fatal("configured algorithm not accepted")
+	}
+	// 回复协商结果之前，只接受压缩的报文，不压缩发送的报文
+	if c.inbound() != Zlib || c.outbound() != nil {
+		t.Fatal("outbound compression enabled before activate")
+	}
+	c.activate()
+	if c.outbound() != Zlib {
+		t.Fatal("outbound compression not enabled after activate")
+	}
+
+	// V1 报文头不支持压缩
+	var v1 compression
+	if v1.accept(&Config{PacketVersion: PacketV1, Compressor: Zlib}, []byte{Zlib.ID()}) != nil {
+		t.Fatal("accepted compression on a v1 connection")
+	}
+}
+
+func TestBroadcastPacketCompressOnce(t *testing.T) {
+	config := &Config{PacketVersion: PacketV2, Compressor: Flate}
+	bp := NewBroadcastPacket(PackingVersionOpcode(PacketV2, 1, bytes.Repeat([]byte("b"), 1024)))
+
+	b, err := SerializeVersion(bp, PacketV2)
+	if err != nil {
+		t.Fatalf("SerializeVersion: %v", err)
+	}
+	first := config.compress(bp, b, Flate)
+	second := config.compress(bp, b, Flate)
+	if !bytes.Equal(first, second) || len(bp.compressed) != 1 {
+		t.Fatalf("got %d compressed results, want 1", len(bp.compressed))
+	}
+}
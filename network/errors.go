@@ -8,4 +8,11 @@ var (
 	ErrUserNoIn           = errors.New("user no in instance")
 	ErrWrongOpCode        = errors.New("wrong opcode")
 	ErrWsListenerClosed   = errors.New("websocket listener closed")
+	ErrCipher             = errors.New("unsupported cipher")
+	ErrCipherMismatch     = errors.New("cipher mismatch")
+	ErrCipherNetwork      = errors.New("cipher not supported on network: ")
+	ErrSecureRecord       = errors.New("bad secure record")
+	ErrSecureHandshake    = errors.New("secure handshake not complete")
+	ErrCompressor         = errors.New("unknown compressor")
+	ErrCompressCorrupt    = errors.New("corrupt compressed packet")
 )
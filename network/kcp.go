@@ -16,8 +16,9 @@ type (
 	}
 
 	KcpConn struct {
-		conn   net.Conn
-		config *Config
+		conn        net.Conn
+		config      *Config
+		compression compression // 协商后的压缩算法
 	}
 )
 
@@ -51,12 +52,15 @@ func (l *KcpListener) Accept() (Conn, error) {
 	kcpConn.SetWriteBuffer(4 * 65536 * 1024)
 	kcpConn.SetACKNoDelay(true)
 
+	var conn net.Conn = kcpConn
 	if l.config.TLSConfig != nil {
-		tlsConn := tls.Server(kcpConn, l.config.TLSConfig)
-		return NewKcpConn(tlsConn, l.config), nil
+		conn = tls.Server(conn, l.config.TLSConfig)
+	}
+	if l.config.Cipher != "" {
+		conn = SecureServer(conn, l.config.Cipher)
 	}
 
-	return NewKcpConn(kcpConn, l.config), nil
+	return NewKcpConn(conn, l.config), nil
 }
 
 // Close 关闭连接的监听器
@@ -71,11 +75,19 @@ func NewKcpConn(c net.Conn, config *Config) Conn {
 
 // ReadPacket 读取报文
 func (k *KcpConn) ReadPacket() (Packet, error) {
+	if err := secureHandshake(k.conn); err != nil {
+		return nil, err
+	}
 	if k.config.ReadTimeout > 0 {
 		k.conn.SetReadDeadline(time.Now().Add(time.Duration(k.config.ReadTimeout) * time.Second))
 	}
 
-	return PackingReader(k.conn)
+	p, err := PackingReader(k.conn, k.config.Version())
+	if err != nil {
+		return nil, err
+	}
+	k.config.onRead(p)
+	return k.config.decompress(p, k.compression.inbound())
 }
 
 // WritePacket 写入报文
@@ -84,8 +96,27 @@ func (k *KcpConn) WritePacket(p Packet) error {
 		k.conn.SetWriteDeadline(time.Now().Add(time.Duration(k.config.WriteTimeout) * time.Second))
 	}
 
-	_, err := k.conn.Write(p.Serialize())
-	return err
+	b, err := SerializeVersion(p, k.config.Version())
+	if err != nil {
+		return err
+	}
+	b = k.config.compress(p, b, k.compression.outbound())
+
+	if _, err = k.conn.Write(b); err != nil {
+		return err
+	}
+	k.config.onWrite(len(b))
+	return nil
+}
+
+// AcceptCompressor 协商连接的压缩算法，之后接受此算法压缩的报文
+func (k *KcpConn) AcceptCompressor(ids []byte) Compressor {
+	return k.compression.accept(k.config, ids)
+}
+
+// ActivateCompressor 之后发送的报文使用协商的压缩算法压缩
+func (k *KcpConn) ActivateCompressor() {
+	k.compression.activate()
 }
 
 // GetReadIP 获取真实的IP
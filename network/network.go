@@ -5,8 +5,10 @@ package network
 
 import (
 	"crypto/tls"
+	"net/http"
 
 	"github.com/pkg/errors"
+	"github.com/trainking/lulu/logger"
 )
 
 const (
@@ -40,6 +42,15 @@ type (
 		Close()
 	}
 
+	// Stats 连接的流量统计，由监听器创建的所有连接共享
+	Stats interface {
+		// OnRead 读取到一个报文，n 为报文的字节数
+		OnRead(n int)
+
+		// OnWrite 写入了一个报文，n 为报文的字节数
+		OnWrite(n int)
+	}
+
 	// Config 网络配置
 	Config struct {
 		Addr         string      // 监听地址
@@ -47,8 +58,17 @@ type (
 		WriteTimeout int         // 写入超时时间
 		ReadTimeout  int         // 读取超时时间
 
-		WSUpgradePath string // websocket升级路径
-		KcpMode       string // kcp模式
+		WSUpgradePath string        // websocket升级路径
+		HTTPHandler   http.Handler  // websocket 监听器处理升级路径以外请求的 Handler，为空时返回 404
+		KcpMode       string        // kcp模式
+		PacketVersion PacketVersion // 报文头版本，默认 PacketV1
+		Logger        logger.Logger // 日志，默认 logger.Default()
+		Stats         Stats         // 流量统计，为空时不统计
+		Cipher        Cipher        // 报文加密算法，为空时不加密；只支持 tcp 和 kcp
+
+		Compressor        Compressor // 发送报文使用的压缩算法，为空时不压缩；只对 V2 报文头生效
+		CompressThreshold int        // 包体不小于此字节数时压缩，默认 DefaultCompressThreshold
+		MaxDecompressSize int        // 解压后包体的最大字节数，超过时断开连接，默认 DefaultMaxDecompressSize
 	}
 
 	// ListenerFactory 监听器工厂
@@ -60,6 +80,14 @@ type (
 		tlsConf       *tls.Config
 		kcpMode       string
 		wsUpgradePath string
+		packetVersion PacketVersion
+		logger        logger.Logger
+		stats         Stats
+		cipher        Cipher
+		compressor    Compressor
+		compressMin   int
+		decompressMax int
+		httpHandler   http.Handler
 	}
 )
 
@@ -88,18 +116,80 @@ func (l *ListenerFactory) WithUpgradePath(wsUpgradePath string) {
 	l.wsUpgradePath = wsUpgradePath
 }
 
+// WithHTTPHandler 设置 websocket 监听器处理升级路径以外请求的 Handler，
+// 如传入 http.DefaultServeMux 以继续提供健康检查、pprof 等接口
+func (l *ListenerFactory) WithHTTPHandler(h http.Handler) {
+	l.httpHandler = h
+}
+
+// WithPacketVersion 设置报文头版本
+func (l *ListenerFactory) WithPacketVersion(version PacketVersion) {
+	l.packetVersion = version
+}
+
+// WithLogger 设置监听器使用的日志
+func (l *ListenerFactory) WithLogger(log logger.Logger) {
+	l.logger = log
+}
+
+// WithStats 设置连接的流量统计
+func (l *ListenerFactory) WithStats(stats Stats) {
+	l.stats = stats
+}
+
+// WithCipher 设置报文加密算法
+func (l *ListenerFactory) WithCipher(c Cipher) {
+	l.cipher = c
+}
+
+// WithCompressor 设置发送报文使用的压缩算法，包体不小于 threshold 字节时压缩
+func (l *ListenerFactory) WithCompressor(c Compressor, threshold int) {
+	l.compressor = c
+	l.compressMin = threshold
+}
+
+// WithMaxDecompressSize 设置解压后包体的最大字节数
+func (l *ListenerFactory) WithMaxDecompressSize(n int) {
+	l.decompressMax = n
+}
+
 // Generate 创建监听器
 func (l *ListenerFactory) Generate() (Listener, error) {
 	var netConfig = Config{
-		Addr:         l.address,
-		WriteTimeout: l.writeTimeout,
-		ReadTimeout:  l.readTimeout,
+		Addr:          l.address,
+		WriteTimeout:  l.writeTimeout,
+		ReadTimeout:   l.readTimeout,
+		PacketVersion: l.packetVersion,
+		Logger:        l.logger,
+		Stats:         l.stats,
+		Cipher:        l.cipher,
+
+		Compressor:        l.compressor,
+		CompressThreshold: l.compressMin,
+		MaxDecompressSize: l.decompressMax,
+
+		HTTPHandler: l.httpHandler,
 	}
 
 	if l.tlsConf != nil {
 		netConfig.TLSConfig = l.tlsConf
 	}
 
+	if netConfig.PacketVersion == 0 {
+		netConfig.PacketVersion = PacketV1
+	}
+	if !netConfig.PacketVersion.Valid() {
+		return nil, ErrPacketVersion
+	}
+	if netConfig.Cipher != "" {
+		if !netConfig.Cipher.Valid() {
+			return nil, errors.Wrap(ErrCipher, string(netConfig.Cipher))
+		}
+		if l.network == WebSocketNet {
+			return nil, errors.Wrap(ErrCipherNetwork, l.network)
+		}
+	}
+
 	var listener Listener
 	var err error
 
@@ -118,3 +208,33 @@ func (l *ListenerFactory) Generate() (Listener, error) {
 
 	return listener, err
 }
+
+// Version 返回连接使用的报文头版本，未设置时为 PacketV1
+func (c *Config) Version() PacketVersion {
+	if c.PacketVersion == 0 {
+		return PacketV1
+	}
+	return c.PacketVersion
+}
+
+// Log 返回网络层使用的日志，未设置时为 logger.Default()
+func (c *Config) Log() logger.Logger {
+	if c.Logger == nil {
+		return logger.Default()
+	}
+	return c.Logger
+}
+
+// onRead 统计读取的报文
+func (c *Config) onRead(p Packet) {
+	if c.Stats != nil {
+		c.Stats.OnRead(len(p.Serialize()))
+	}
+}
+
+// onWrite 统计写入的报文
+func (c *Config) onWrite(n int) {
+	if c.Stats != nil {
+		c.Stats.OnWrite(n)
+	}
+}
@@ -10,6 +10,34 @@ import (
 const (
 	// MaxPacketSize 最大包体大小限制（64MB），防止内存攻击
 	MaxPacketSize = 64 * 1024 * 1024
+
+	// MaxPacketV1Size V1 报文头能够表示的最大包体大小
+	MaxPacketV1Size = 0xFFFF
+)
+
+const (
+	// PacketV1 旧版报文头：2 字节包体长度 + 2 字节 OpCode
+	PacketV1 PacketVersion = iota + 1
+
+	// PacketV2 扩展报文头：1 字节标志位 + 4 字节包体长度 + 2 字节 OpCode，标志位可扩展可选字段
+	PacketV2
+)
+
+const (
+	// FlagSeq V2 报文头标志位，OpCode 后追加 4 字节的请求序列号
+	FlagSeq uint8 = 1 << iota
+
+	// FlagCompress V2 报文头标志位，包体已压缩；序列号之后追加 1 字节的压缩算法编号，包体长度为压缩后的长度
+	FlagCompress
+
+	// flagMask 已定义的标志位
+	flagMask = FlagSeq | FlagCompress
+)
+
+const (
+	packetV1HeadLen = 4 // V1 报文头长度
+	packetV2HeadLen = 7 // V2 报文头长度
+	packetSeqLen    = 4 // 序列号长度
 )
 
 var (
@@ -22,9 +50,21 @@ var (
 
 	// ErrPacketTooLarge 包体大小超过限制
 	ErrPacketTooLarge = errors.New("packet too large")
+
+	// ErrPacketFlag 无法识别的报文标志位
+	ErrPacketFlag = errors.New("unknown packet flag")
+
+	// ErrPacketVersion 不支持的报文头版本
+	ErrPacketVersion = errors.New("unsupported packet version")
+
+	// ErrPacketSeq 序列号只能在 V2 报文头中使用
+	ErrPacketSeq = errors.New("packet seq requires v2 header")
 )
 
 type (
+	// PacketVersion 报文头的版本
+	PacketVersion uint8
+
 	// Packet 对数据打包的接口
 	Packet interface {
 		// Serialize 序列化
@@ -34,7 +74,10 @@ type (
 		OpCode() uint16
 
 		// BodyLen 内容长度
-		BodyLen() uint16
+		BodyLen() uint32
+
+		// Seq 请求序列号，0 表示没有序列号
+		Seq() uint32
 
 		// Body 获取完整 body
 		Body() []byte
@@ -45,14 +88,29 @@ type (
 
 	// DefaultPacket 默认的包实现
 	DefaultPacket struct {
-		buff []byte
+		buff    []byte
+		version PacketVersion
 	}
 )
 
-// NewDefaultPacket 创建一个默认的包
-func NewDefaultPacket(buff []byte) Packet {
+// Valid 是否为支持的报文头版本
+func (v PacketVersion) Valid() bool {
+	return v == PacketV1 || v == PacketV2
+}
+
+// headLen 报文头的长度
+func (v PacketVersion) headLen() int {
+	if v == PacketV2 {
+		return packetV2HeadLen
+	}
+	return packetV1HeadLen
+}
+
+// NewDefaultPacket 使用指定版本的报文头，创建一个默认的包
+func NewDefaultPacket(version PacketVersion, buff []byte) Packet {
 	p := DefaultPacketPool.Get().(*DefaultPacket)
 	p.buff = buff
+	p.version = version
 
 	return p
 }
@@ -62,19 +120,55 @@ func (p *DefaultPacket) Serialize() []byte {
 	return p.buff
 }
 
-// OpCode 包的 2-3 位为 OpCode
+// Version 报文头的版本
+func (p *DefaultPacket) Version() PacketVersion {
+	return p.version
+}
+
+// flag V2 报文头的标志位，V1 报文头没有标志位
+func (p *DefaultPacket) flag() uint8 {
+	if p.version == PacketV2 {
+		return p.buff[0]
+	}
+	return 0
+}
+
+// headLen 包含可选字段在内的完整报文头长度
+func (p *DefaultPacket) headLen() int {
+	l := p.version.headLen()
+	if p.flag()&FlagSeq != 0 {
+		l += packetSeqLen
+	}
+	if p.flag()&FlagCompress != 0 {
+		l += packetCompressLen
+	}
+	return l
+}
+
+// OpCode V1 包的 2-3 位为 OpCode；V2 包的 5-6 位为 OpCode
 func (p *DefaultPacket) OpCode() uint16 {
+	if p.version == PacketV2 {
+		return binary.BigEndian.Uint16(p.buff[5:7])
+	}
 	return binary.BigEndian.Uint16(p.buff[2:4])
 }
 
-// BodyLen 报文内容长度
-func (p *DefaultPacket) BodyLen() uint16 {
-	return binary.BigEndian.Uint16(p.buff[0:2])
+// BodyLen 报文内容长度，以实际的包体为准，避免 V1 头部长度截断
+func (p *DefaultPacket) BodyLen() uint32 {
+	return uint32(len(p.buff) - p.headLen())
+}
+
+// Seq V2 包带有 FlagSeq 时，OpCode 之后的 4 字节为序列号
+func (p *DefaultPacket) Seq() uint32 {
+	if p.flag()&FlagSeq == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(p.buff[packetV2HeadLen : packetV2HeadLen+packetSeqLen])
 }
 
 // Body 读取 body 所有字符
 func (p *DefaultPacket) Body() []byte {
-	return p.buff[4:]
+	return p.buff[p.headLen():]
 }
 
 // Free 释放空间
@@ -85,51 +179,153 @@ func (p *DefaultPacket) Free() {
 	DefaultPacketPool.Put(p)
 }
 
-// PackingReader 从 io.Reader 中读取一个 Packet
-func PackingReader(r io.Reader) (Packet, error) {
-	// 4 字节头
-	var headrBytes = make([]byte, 4)
+// PackingReader 从 io.Reader 中按指定版本的报文头读取一个 Packet
+func PackingReader(r io.Reader, version PacketVersion) (Packet, error) {
+	if !version.Valid() {
+		return nil, ErrPacketVersion
+	}
+
+	headLen := version.headLen()
+	var headrBytes = make([]byte, headLen)
 
 	// 读取头
 	if _, err := io.ReadFull(r, headrBytes); err != nil {
 		return nil, err
 	}
 
-	bodyLength := binary.BigEndian.Uint16(headrBytes[0:2])
+	bodyLength, optLen, err := parseHead(headrBytes, version)
+	if err != nil {
+		return nil, err
+	}
 
-	// 检查包体大小限制
-	if int(bodyLength) > MaxPacketSize {
-		return nil, ErrPacketTooLarge
+	// 可选字段和 body 一起读取
+	pbuff := make([]byte, headLen+optLen+int(bodyLength))
+	copy(pbuff, headrBytes)
+	if len(pbuff) > headLen {
+		if _, err := io.ReadFull(r, pbuff[headLen:]); err != nil {
+			return nil, err
+		}
 	}
 
-	var buff []byte
-	if bodyLength > 0 {
-		buff = make([]byte, bodyLength)
+	return NewDefaultPacket(version, pbuff), nil
+}
 
-		// 读取 body
-		if _, err := io.ReadFull(r, buff); err != nil {
-			return nil, err
+// parseHead 解析报文头，返回包体长度和可选字段的长度
+func parseHead(head []byte, version PacketVersion) (uint32, int, error) {
+	var bodyLength uint32
+	var optLen int
+	if version == PacketV2 {
+		flag := head[0]
+		if flag&^flagMask != 0 {
+			return 0, 0, ErrPacketFlag
 		}
+		if flag&FlagSeq != 0 {
+			optLen += packetSeqLen
+		}
+		if flag&FlagCompress != 0 {
+			optLen += packetCompressLen
+		}
+		bodyLength = binary.BigEndian.Uint32(head[1:5])
+	} else {
+		bodyLength = uint32(binary.BigEndian.Uint16(head[0:2]))
+	}
+
+	// 检查包体大小限制
+	if bodyLength > MaxPacketSize {
+		return 0, 0, ErrPacketTooLarge
 	}
 
-	pbuff := make([]byte, 4+len(buff))
-	copy(pbuff[0:], headrBytes)
-	if bodyLength > 0 {
-		copy(pbuff[4:], buff)
+	return bodyLength, optLen, nil
+}
+
+// PackingBytes 从一段完整的报文中解析 Packet，用于 websocket 这类自带消息边界的传输
+func PackingBytes(buff []byte, version PacketVersion) (Packet, error) {
+	if !version.Valid() {
+		return nil, ErrPacketVersion
+	}
+
+	headLen := version.headLen()
+	if len(buff) < headLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	bodyLength, optLen, err := parseHead(buff[:headLen], version)
+	if err != nil {
+		return nil, err
+	}
+	if headLen+optLen+int(bodyLength) != len(buff) {
+		return nil, io.ErrUnexpectedEOF
 	}
 
-	return NewDefaultPacket(pbuff), nil
+	return NewDefaultPacket(version, buff), nil
 }
 
-// PackingOpcode 加入 opcode 方式，创建一个 Packet
+// PackingOpcode 加入 opcode 方式，创建一个 V1 报文头的 Packet
 func PackingOpcode(opcode uint16, msg []byte) Packet {
+	return PackingVersionOpcode(PacketV1, opcode, msg)
+}
+
+// PackingVersionOpcode 加入 opcode 方式，创建一个指定版本报文头的 Packet；
+// V1 报文头无法表示超过 MaxPacketV1Size 的长度，写入连接时会返回 ErrPacketTooLarge
+func PackingVersionOpcode(version PacketVersion, opcode uint16, msg []byte) Packet {
+	return NewDefaultPacket(version, packingBuff(version, opcode, 0, msg))
+}
+
+// PackingSeqOpcode 加入 opcode 和请求序列号，创建一个 V2 报文头的 Packet；seq 为 0 时不携带序列号
+func PackingSeqOpcode(opcode uint16, seq uint32, msg []byte) Packet {
+	return NewDefaultPacket(PacketV2, packingBuff(PacketV2, opcode, seq, msg))
+}
+
+// packingBuff 按报文头版本生成完整的报文字节，seq 仅在 V2 报文头中写入
+func packingBuff(version PacketVersion, opcode uint16, seq uint32, msg []byte) []byte {
+	headLen := version.headLen()
+	if version == PacketV2 && seq != 0 {
+		headLen += packetSeqLen
+	}
 	bodyLen := len(msg)
-	buff := make([]byte, 4+bodyLen)
-	binary.BigEndian.PutUint16(buff[0:2], uint16(bodyLen))
-	binary.BigEndian.PutUint16(buff[2:4], opcode)
+	buff := make([]byte, headLen+bodyLen)
+	if version == PacketV2 {
+		binary.BigEndian.PutUint32(buff[1:5], uint32(bodyLen))
+		binary.BigEndian.PutUint16(buff[5:7], opcode)
+		if seq != 0 {
+			buff[0] |= FlagSeq
+			binary.BigEndian.PutUint32(buff[packetV2HeadLen:packetV2HeadLen+packetSeqLen], seq)
+		}
+	} else {
+		binary.BigEndian.PutUint16(buff[0:2], uint16(bodyLen))
+		binary.BigEndian.PutUint16(buff[2:4], opcode)
+	}
 	if bodyLen > 0 {
-		copy(buff[4:], msg)
+		copy(buff[headLen:], msg)
+	}
+
+	return buff
+}
+
+// SerializeVersion 按连接使用的报文头版本序列化 Packet，版本不一致时重新打包
+func SerializeVersion(p Packet, version PacketVersion) ([]byte, error) {
+	if !version.Valid() {
+		return nil, ErrPacketVersion
+	}
+
+	if bp, ok := p.(*BroadcastPacket); ok {
+		p = bp.Packet
+	}
+	if dp, ok := p.(*DefaultPacket); ok && dp.version == version {
+		if version == PacketV1 && dp.BodyLen() > MaxPacketV1Size {
+			return nil, ErrPacketTooLarge
+		}
+		return dp.Serialize(), nil
+	}
+
+	if version == PacketV1 && p.Seq() != 0 {
+		return nil, ErrPacketSeq
+	}
+
+	body := p.Body()
+	if len(body) > MaxPacketSize || (version == PacketV1 && len(body) > MaxPacketV1Size) {
+		return nil, ErrPacketTooLarge
 	}
 
-	return NewDefaultPacket(buff)
+	return packingBuff(version, p.OpCode(), p.Seq(), body), nil
 }
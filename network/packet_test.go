@@ -0,0 +1,112 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPackingReaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		version PacketVersion
+		opcode  uint16
+		seq     uint32
+		body    []byte
+	}{
+		{"v1 empty", PacketV1, 1, 0, nil},
+		{"v1 body", PacketV1, 1001, 0, []byte("hello")},
+		{"v2 body", PacketV2, 1002, 0, []byte("hello")},
+		{"v2 seq", PacketV2, 1003, 42, []byte("world")},
+		{"v2 seq empty", PacketV2, 65535, 7, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Packet
+			if tt.seq != 0 {
+				p = PackingSeqOpcode(tt.opcode, tt.seq, tt.body)
+			} else {
+				p = PackingVersionOpcode(tt.version, tt.opcode, tt.body)
+			}
+
+			b, err := SerializeVersion(p, tt.version)
+			if err != nil {
+				t.Fatalf("SerializeVersion: %v", err)
+			}
+			for _, parse := range []func() (Packet, error){
+				func() (Packet, error) { return PackingReader(bytes.NewReader(b), tt.version) },
+				func() (Packet, error) { return PackingBytes(b, tt.version) },
+			} {
+				got, err := parse()
+				if err != nil {
+					t.Fatalf("parse: %v", err)
+				}
+				if got.OpCode() != tt.opcode || got.Seq() != tt.seq || !bytes.Equal(got.Body(), tt.body) {
+					t.Fatalf("got opcode %d seq %d body %q, want %d %d %q", got.OpCode(), got.Seq(), got.Body(), tt.opcode, tt.seq, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestSerializeVersionConvert(t *testing.T) {
+	v1 := PackingVersionOpcode(PacketV1, 10, []byte("body"))
+	b, err := SerializeVersion(v1, PacketV2)
+	if err != nil {
+		t.Fatalf("SerializeVersion v1 to v2: %v", err)
+	}
+	p, err := PackingBytes(b, PacketV2)
+	if err != nil {
+		t.Fatalf("PackingBytes: %v", err)
+	}
+	if p.OpCode() != 10 || string(p.Body()) != "body" {
+		t.Fatalf("got opcode %d body %q", p.OpCode(), p.Body())
+	}
+
+	b, err = SerializeVersion(PackingVersionOpcode(PacketV2, 11, []byte("body")), PacketV1)
+	if err != nil {
+		t.Fatalf("SerializeVersion v2 to v1: %v", err)
+	}
+	if p, err = PackingBytes(b, PacketV1); err != nil || p.OpCode() != 11 || string(p.Body()) != "body" {
+		t.Fatalf("got %v, %v", p, err)
+	}
+
+	// 序列号无法用 V1 报文头表示
+	if _, err := SerializeVersion(PackingSeqOpcode(12, 1, nil), PacketV1); !errors.Is(err, ErrPacketSeq) {
+		t.Fatalf("seq to v1: got %v, want ErrPacketSeq", err)
+	}
+	// 超过 V1 长度的包体
+	large := make([]byte, MaxPacketV1Size+1)
+	if _, err := SerializeVersion(PackingVersionOpcode(PacketV2, 13, large), PacketV1); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("large to v1: got %v, want ErrPacketTooLarge", err)
+	}
+	if _, err := SerializeVersion(PackingVersionOpcode(PacketV1, 13, large), PacketV1); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("large v1: got %v, want ErrPacketTooLarge", err)
+	}
+	if _, err := SerializeVersion(v1, PacketVersion(3)); !errors.Is(err, ErrPacketVersion) {
+		t.Fatalf("unknown version: got %v, want ErrPacketVersion", err)
+	}
+}
+
+func TestParseHeadErrors(t *testing.T) {
+	// 无法识别的标志位
+	b := PackingVersionOpcode(PacketV2, 1, nil).Serialize()
+	b[0] = 0x80
+	if _, err := PackingBytes(b, PacketV2); !errors.Is(err, ErrPacketFlag) {
+		t.Fatalf("unknown flag: got %v, want ErrPacketFlag", err)
+	}
+
+	// 声明的包体长度超过上限，不读取包体
+	b = PackingVersionOpcode(PacketV2, 1, nil).Serialize()
+	b[1], b[2], b[3], b[4] = 0xFF, 0xFF, 0xFF, 0xFF
+	if _, err := PackingReader(bytes.NewReader(b), PacketV2); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("too large: got %v, want ErrPacketTooLarge", err)
+	}
+
+	// 长度与实际数据不一致
+	b = PackingVersionOpcode(PacketV1, 1, []byte("abc")).Serialize()
+	if _, err := PackingBytes(b[:len(b)-1], PacketV1); err == nil {
+		t.Fatal("truncated packet: got nil error")
+	}
+}
@@ -0,0 +1,291 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	CipherChaCha20 Cipher = "chacha20-poly1305" // ChaCha20-Poly1305，没有 AES 硬件加速的设备上更快
+	CipherAESGCM   Cipher = "aes-gcm"           // AES-256-GCM
+)
+
+const (
+	secureKeyLen    = 32 // X25519 公钥和 AEAD 密钥的长度
+	secureHelloLen  = 1 + secureKeyLen
+	secureRecordLen = 4 // 加密记录的长度头
+	secureNonceLen  = 12
+
+	// secureMaxRecord 加密记录的最大长度，为最大的报文加上报文头和认证标签
+	secureMaxRecord = MaxPacketSize + 64
+
+	// secureHandshakeTimeout 服务端等待客户端握手的最长时间
+	secureHandshakeTimeout = 10 * time.Second
+)
+
+// secureInfo 派生会话密钥使用的 HKDF info
+var secureInfo = []byte("lulu secure v1")
+
+type (
+	// Cipher 报文加密算法
+	Cipher string
+
+	// SecureConn 加密连接，使用 X25519 交换密钥，之后每次写入作为一条记录，使用 AEAD 加密；
+	// 两个方向使用独立的密钥，随机数为递增的计数器，不在记录中传输。
+	// 客户端在第一次读写时握手；服务端在第一次读取时握手，握手完成前的写入直接返回 ErrSecureHandshake
+	SecureConn struct {
+		net.Conn
+		cipher   Cipher
+		isClient bool
+
+		handshakeOnce sync.Once
+		handshakeDone chan struct{} // 握手完成后关闭
+		handshakeErr  error
+
+		in      cipher.AEAD
+		inSeq   uint64
+		inBuf   []byte // 已解密但还未读取的数据
+		readMu  sync.Mutex
+		out     cipher.AEAD
+		outSeq  uint64
+		writeMu sync.Mutex
+	}
+)
+
+// Valid 是否为支持的加密算法
+func (c Cipher) Valid() bool {
+	return c.id() != 0
+}
+
+// id 握手时使用的算法编号
+func (c Cipher) id() byte {
+	switch c {
+	case CipherChaCha20:
+		return 1
+	case CipherAESGCM:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// aead 使用 key 创建 AEAD
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherChaCha20:
+		return chacha20poly1305.New(key)
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, ErrCipher
+	}
+}
+
+// SecureServer 服务端的加密连接，在第一次读取时握手
+func SecureServer(conn net.Conn, c Cipher) *SecureConn {
+	return &SecureConn{Conn: conn, cipher: c, handshakeDone: make(chan struct{})}
+}
+
+// SecureClient 客户端的加密连接，与 tls.Client 一样在第一次读写时握手
+func SecureClient(conn net.Conn, c Cipher) *SecureConn {
+	return &SecureConn{Conn: conn, cipher: c, isClient: true, handshakeDone: make(chan struct{})}
+}
+
+// Handshake 交换密钥；客户端发送算法编号和公钥，服务端校验算法后回复算法编号和公钥。
+// 握手没有验证服务端的身份，只能防止被动窃听，需要防止中间人时使用 TLS。
+// 服务端握手使用独立的超时时间，握手期间不持有锁，关闭连接即可中断握手
+func (c *SecureConn) Handshake() error {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshake()
+		close(c.handshakeDone)
+	})
+	return c.handshakeErr
+}
+
+// handshaked 握手是否已经完成，未完成时返回 ErrSecureHandshake
+func (c *SecureConn) handshaked() error {
+	select {
+	case <-c.handshakeDone:
+		return c.handshakeErr
+	default:
+		return ErrSecureHandshake
+	}
+}
+
+// handshake 执行握手，只在 Handshake 中调用一次
+func (c *SecureConn) handshake() error {
+	id := c.cipher.id()
+	if id == 0 {
+		return ErrCipher
+	}
+
+	if !c.isClient {
+		c.Conn.SetDeadline(time.Now().Add(secureHandshakeTimeout))
+		defer c.Conn.SetDeadline(time.Time{})
+	}
+
+	priv := make([]byte, secureKeyLen)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	hello := append([]byte{id}, pub...)
+
+	peer := make([]byte, secureHelloLen)
+	if c.isClient {
+		if _, err := c.Conn.Write(hello); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.Conn, peer); err != nil {
+			return err
+		}
+		if peer[0] != id {
+			return ErrCipherMismatch
+		}
+	} else {
+		if _, err := io.ReadFull(c.Conn, peer); err != nil {
+			return err
+		}
+		if peer[0] != id {
+			return ErrCipherMismatch
+		}
+		if _, err := c.Conn.Write(hello); err != nil {
+			return err
+		}
+	}
+
+	// 拒绝低阶点等无效的公钥
+	shared, err := curve25519.X25519(priv, peer[1:])
+	if err != nil {
+		return err
+	}
+
+	// 以双方的公钥为盐派生两个方向的密钥，先客户端后服务端
+	salt := make([]byte, 0, 2*secureKeyLen)
+	if c.isClient {
+		salt = append(append(salt, pub...), peer[1:]...)
+	} else {
+		salt = append(append(salt, peer[1:]...), pub...)
+	}
+	keys := make([]byte, 2*secureKeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, secureInfo), keys); err != nil {
+		return err
+	}
+	// 前半部分为客户端写入使用的密钥，后半部分为服务端写入使用的密钥
+	outKey, inKey := keys[:secureKeyLen], keys[secureKeyLen:]
+	if !c.isClient {
+		outKey, inKey = inKey, outKey
+	}
+
+	if c.out, err = c.cipher.aead(outKey); err != nil {
+		return err
+	}
+	if c.in, err = c.cipher.aead(inKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nonce 计数器对应的随机数
+func secureNonce(seq uint64) []byte {
+	nonce := make([]byte, secureNonceLen)
+	binary.BigEndian.PutUint64(nonce[secureNonceLen-8:], seq)
+	return nonce
+}
+
+// Write 将 b 加密为一条记录写入：4 字节的密文长度，后跟密文
+func (c *SecureConn) Write(b []byte) (int, error) {
+	handshake := c.Handshake
+	if !c.isClient {
+		// 服务端的握手由读取协程完成，写入不等待握手
+		handshake = c.handshaked
+	}
+	if err := handshake(); err != nil {
+		return 0, err
+	}
+	if len(b)+c.out.Overhead() > secureMaxRecord {
+		return 0, ErrPacketTooLarge
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	record := make([]byte, secureRecordLen, secureRecordLen+len(b)+c.out.Overhead())
+	binary.BigEndian.PutUint32(record, uint32(len(b)+c.out.Overhead()))
+	record = c.out.Seal(record, secureNonce(c.outSeq), b, record[:secureRecordLen])
+	c.outSeq++
+
+	if _, err := c.Conn.Write(record); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read 读取解密后的数据，一条记录可以分多次读取
+func (c *SecureConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.inBuf) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.inBuf)
+	c.inBuf = c.inBuf[n:]
+	return n, nil
+}
+
+// readRecord 读取并解密一条记录，需要持有 readMu 调用
+func (c *SecureConn) readRecord() error {
+	head := make([]byte, secureRecordLen)
+	if _, err := io.ReadFull(c.Conn, head); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(head)
+	if n < uint32(c.in.Overhead()) || n > secureMaxRecord {
+		return ErrSecureRecord
+	}
+
+	record := make([]byte, n)
+	if _, err := io.ReadFull(c.Conn, record); err != nil {
+		return err
+	}
+	plain, err := c.in.Open(record[:0], secureNonce(c.inSeq), record, head)
+	if err != nil {
+		return ErrSecureRecord
+	}
+	c.inSeq++
+	c.inBuf = plain
+	return nil
+}
+
+// secureHandshake conn 为加密连接时完成握手；在设置读取超时之前调用，避免握手的超时覆盖读取超时
+func secureHandshake(conn net.Conn) error {
+	if sc, ok := conn.(*SecureConn); ok {
+		return sc.Handshake()
+	}
+	return nil
+}
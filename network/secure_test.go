@@ -0,0 +1,191 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// securePair 创建一对加密的 V2 连接，服务端和客户端分别使用 server 和 client 算法
+func securePair(t *testing.T, server, client Cipher) (Conn, Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	config := &Config{PacketVersion: PacketV2}
+	s, _ := NewTcpConn(SecureServer(a, server), config)
+	c, _ := NewTcpConn(SecureClient(b, client), config)
+	return s, c
+}
+
+func TestSecureConnRoundTrip(t *testing.T) {
+	for _, cipher := range []Cipher{CipherChaCha20, CipherAESGCM} {
+		t.Run(string(cipher), func(t *testing.T) {
+			s, c := securePair(t, cipher, cipher)
+
+			errc := make(chan error, 1)
+			go func() { errc <- c.WritePacket(PackingSeqOpcode(1, 7, []byte("ping"))) }()
+			p, err := s.ReadPacket()
+			if err != nil {
+				t.Fatalf("server ReadPacket: %v", err)
+			}
+			if p.OpCode() != 1 || p.Seq() != 7 || string(p.Body()) != "ping" {
+				t.Fatalf("got opcode %d seq %d body %q", p.OpCode(), p.Seq(), p.Body())
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("client WritePacket: %v", err)
+			}
+
+			// 多个报文使用递增的随机数
+			go func() {
+				for i := 0; i < 3; i++ {
+					s.WritePacket(PackingSeqOpcode(2, uint32(i+1), bytes.Repeat([]byte{byte(i)}, 1024)))
+				}
+			}()
+			for i := 0; i < 3; i++ {
+				p, err := c.ReadPacket()
+				if err != nil {
+					t.Fatalf("client ReadPacket %d: %v", i, err)
+				}
+				if p.Seq() != uint32(i+1) || !bytes.Equal(p.Body(), bytes.Repeat([]byte{byte(i)}, 1024)) {
+					t.Fatalf("packet %d mismatch", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSecureConnCipherMismatch(t *testing.T) {
+	s, c := securePair(t, CipherChaCha20, CipherAESGCM)
+
+	go c.WritePacket(PackingOpcode(1, nil))
+	if _, err := s.ReadPacket(); !errors.Is(err, ErrCipherMismatch) {
+		t.Fatalf("got %v, want ErrCipherMismatch", err)
+	}
+}
+
+func TestSecureConnWriteBeforeHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	s, _ := NewTcpConn(SecureServer(a, CipherChaCha20), &Config{PacketVersion: PacketV2})
+
+	// 读取协程等待客户端握手时，写入不等待握手，直接返回
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.ReadPacket()
+		errc <- err
+	}()
+	done := make(chan error, 1)
+	go func() { done <- s.WritePacket(PackingOpcode(1, nil)) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSecureHandshake) {
+			t.Fatalf("got %v, want ErrSecureHandshake", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write blocked on the handshake")
+	}
+
+	// 关闭连接中断握手
+	s.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("ReadPacket succeeded on a closed connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake not interrupted by Close")
+	}
+}
+
+// tamperConn 修改写入的记录中的一个字节
+type tamperConn struct {
+	net.Conn
+	records int
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	c.records++
+	// 第一次写入为握手，之后为加密记录
+	if c.records > 1 {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0x01
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSecureConnTamper(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	config := &Config{PacketVersion: PacketV2}
+	s, _ := NewTcpConn(SecureServer(a, CipherChaCha20), config)
+	c, _ := NewTcpConn(SecureClient(&tamperConn{Conn: b}, CipherChaCha20), config)
+
+	go c.WritePacket(PackingOpcode(1, []byte("payload")))
+	if _, err := s.ReadPacket(); !errors.Is(err, ErrSecureRecord) {
+		t.Fatalf("got %v, want ErrSecureRecord", err)
+	}
+}
+
+func TestSecureConnReplay(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	server := SecureServer(a, CipherChaCha20)
+	client := SecureClient(b, CipherChaCha20)
+
+	// 记录客户端写入的第一条加密记录，再重放一次
+	rec := &recordConn{Conn: a}
+	server.Conn = rec
+	go func() {
+		client.Write([]byte("once"))
+		client.Write([]byte("twice"))
+	}()
+
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "once" {
+		t.Fatalf("first record: %q, %v", buf[:n], err)
+	}
+	rec.replay = true
+	if _, err := server.Read(buf); !errors.Is(err, ErrSecureRecord) {
+		t.Fatalf("replayed record: got %v, want ErrSecureRecord", err)
+	}
+}
+
+// recordConn 记录握手之后读取的第一条记录，replay 后再次返回这条记录
+type recordConn struct {
+	net.Conn
+	handshaked bool
+	record     []byte
+	replay     bool
+	pending    []byte
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	if c.replay && c.pending == nil {
+		c.pending = c.record
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if !c.handshaked {
+		if len(b) == secureHelloLen {
+			c.handshaked = true
+		}
+		return n, err
+	}
+	if !c.replay {
+		c.record = append(c.record, b[:n]...)
+	}
+	return n, err
+}
@@ -15,8 +15,9 @@ type (
 
 	// TcpConn TCP连接
 	TcpConn struct {
-		conn   net.Conn
-		config *Config
+		conn        net.Conn
+		config      *Config
+		compression compression // 协商后的压缩算法
 	}
 )
 
@@ -49,8 +50,10 @@ func (l *TcpListener) Accept() (Conn, error) {
 	}
 
 	if l.config.TLSConfig != nil {
-		tlsConn := tls.Server(c, l.config.TLSConfig)
-		return NewTcpConn(tlsConn, l.config)
+		c = tls.Server(c, l.config.TLSConfig)
+	}
+	if l.config.Cipher != "" {
+		c = SecureServer(c, l.config.Cipher)
 	}
 
 	return NewTcpConn(c, l.config)
@@ -63,10 +66,18 @@ func (l *TcpListener) Close() {
 
 // ReadPacket 读取报文
 func (c *TcpConn) ReadPacket() (Packet, error) {
+	if err := secureHandshake(c.conn); err != nil {
+		return nil, err
+	}
 	if c.config.ReadTimeout > 0 {
 		c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.config.ReadTimeout) * time.Second))
 	}
-	return PackingReader(c.conn)
+	p, err := PackingReader(c.conn, c.config.Version())
+	if err != nil {
+		return nil, err
+	}
+	c.config.onRead(p)
+	return c.config.decompress(p, c.compression.inbound())
 }
 
 // WritePacket 写入报文
@@ -75,8 +86,27 @@ func (c *TcpConn) WritePacket(p Packet) error {
 		c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.config.WriteTimeout) * time.Second))
 	}
 
-	_, err := c.conn.Write(p.Serialize())
-	return err
+	b, err := SerializeVersion(p, c.config.Version())
+	if err != nil {
+		return err
+	}
+	b = c.config.compress(p, b, c.compression.outbound())
+
+	if _, err = c.conn.Write(b); err != nil {
+		return err
+	}
+	c.config.onWrite(len(b))
+	return nil
+}
+
+// AcceptCompressor 协商连接的压缩算法，之后接受此算法压缩的报文
+func (c *TcpConn) AcceptCompressor(ids []byte) Compressor {
+	return c.compression.accept(c.config, ids)
+}
+
+// ActivateCompressor 之后发送的报文使用协商的压缩算法压缩
+func (c *TcpConn) ActivateCompressor() {
+	c.compression.activate()
 }
 
 // GetRealIP 获取对端的真实IP
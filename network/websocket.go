@@ -1,13 +1,13 @@
 package network
 
 import (
-	"log"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/trainking/lulu/logger"
 )
 
 const (
@@ -35,6 +35,8 @@ type (
 		realIp   string
 		mu       sync.RWMutex
 		isClosed bool
+
+		compression compression // 协商后的压缩算法
 	}
 )
 
@@ -62,24 +64,31 @@ func NewWebSocketListener(config *Config) (Listener, error) {
 			},
 		},
 	}
-	http.HandleFunc(config.WSUpgradePath, l.handleWebSocket)
+	// 每个监听器使用独立的路由，避免多个监听器在默认路由上重复注册；
+	// 注册在 http.DefaultServeMux 等路由上的接口需要通过 HTTPHandler 传入
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.WSUpgradePath, l.handleWebSocket)
+	if config.HTTPHandler != nil && config.WSUpgradePath != "/" {
+		mux.Handle("/", config.HTTPHandler)
+	}
 
 	server := &http.Server{
-		Addr: config.Addr,
+		Addr:    config.Addr,
+		Handler: mux,
 	}
 
 	if config.TLSConfig != nil {
 		server.TLSConfig = config.TLSConfig
 		go func() {
 			if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
-				log.Printf("Websocket ListenAndServeTLS Error: %s\n", err)
+				config.Log().Error("websocket listen and serve tls failed", logger.String("addr", config.Addr), logger.Err(err))
 			}
 		}()
 
 	} else {
 		go func() {
 			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				log.Printf("Websocket ListenAndServe Error: %s\n", err)
+				config.Log().Error("websocket listen and serve failed", logger.String("addr", config.Addr), logger.Err(err))
 			}
 		}()
 	}
@@ -93,7 +102,7 @@ func NewWebSocketListener(config *Config) (Listener, error) {
 func (l *WebSocketListener) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := l.ugrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket Upgrade Error: %s\n", err)
+		l.config.Log().Warn("websocket upgrade failed", logger.String(logger.KeyRemoteIP, r.RemoteAddr), logger.Err(err))
 		return
 	}
 	clientIP := r.Header.Get("X-Forwarded-For")
@@ -112,7 +121,7 @@ func (l *WebSocketListener) handleWebSocket(w http.ResponseWriter, r *http.Reque
 	case <-l.closeChan:
 		// 监听器已关闭，拒绝新连接
 		wConn.Close()
-		log.Printf("WebSocket Listener closed, reject new connection from %s\n", clientIP)
+		l.config.Log().Info("websocket listener closed, reject new connection", logger.String(logger.KeyRemoteIP, clientIP))
 	}
 }
 
@@ -133,7 +142,7 @@ func (l *WebSocketListener) Close() {
 		close(l.closeChan)
 		if l.server != nil {
 			if err := l.server.Close(); err != nil {
-				log.Printf("WebSocket Listener Close Error: %s\n", err)
+				l.config.Log().Error("websocket listener close failed", logger.String("addr", l.config.Addr), logger.Err(err))
 			}
 		}
 	})
@@ -155,7 +164,12 @@ func (w *WebSocketConn) ReadPacket() (Packet, error) {
 		return nil, err
 	}
 
-	return NewDefaultPacket(message), nil
+	p, err := PackingBytes(message, w.config.Version())
+	if err != nil {
+		return nil, err
+	}
+	w.config.onRead(p)
+	return w.config.decompress(p, w.compression.inbound())
 }
 
 // WritePacket 写入数据包
@@ -171,7 +185,27 @@ func (w *WebSocketConn) WritePacket(p Packet) error {
 		w.conn.SetWriteDeadline(time.Now().Add(time.Duration(w.config.WriteTimeout) * time.Second))
 	}
 
-	return w.conn.WriteMessage(websocket.BinaryMessage, p.Serialize())
+	b, err := SerializeVersion(p, w.config.Version())
+	if err != nil {
+		return err
+	}
+	b = w.config.compress(p, b, w.compression.outbound())
+
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return err
+	}
+	w.config.onWrite(len(b))
+	return nil
+}
+
+// AcceptCompressor 协商连接的压缩算法，之后接受此算法压缩的报文
+func (w *WebSocketConn) AcceptCompressor(ids []byte) Compressor {
+	return w.compression.accept(w.config, ids)
+}
+
+// ActivateCompressor 之后发送的报文使用协商的压缩算法压缩
+func (w *WebSocketConn) ActivateCompressor() {
+	w.compression.activate()
 }
 
 // GetRealIP 获取真实的 IP
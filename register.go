@@ -1,12 +1,22 @@
 package lulu
 
+import "github.com/trainking/lulu/codec"
+
 type (
 	// RegisterParams 注册参数
 	RegisterParams struct {
-		Handler    Handler      // 处理函数
-		IsInner    bool         // 是否是内部请求
-		Middleware []Middleware // 中间件
-		IsNoValid  bool         // 是否无需验证的请求
+		Handler     Handler       // 处理函数
+		IsInner     bool          // 是否是内部请求
+		Middleware  []Middleware  // 中间件
+		IsNoValid   bool          // 是否无需验证的请求
+		Codec       codec.Codec   // 编解码器，为空时使用 App 的编解码器
+		OpCodeRange []OpCodeRange // 允许的 opcode 范围，设置多个时 opcode 需要同时满足
+	}
+
+	// OpCodeRange opcode 的闭区间范围
+	OpCodeRange struct {
+		Min uint16
+		Max uint16
 	}
 
 	// RegisterOptions 注册选项
@@ -60,3 +70,22 @@ func WithRegisterIsNoValid(isNoValid bool) RegisterOptions {
 		o.IsNoValid = isNoValid
 	})
 }
+
+// WithRegisterOpCodeRange 限制路由的 opcode 在 min 到 max 之间（包含两端）
+func WithRegisterOpCodeRange(min, max uint16) RegisterOptions {
+	return RegisterOptionFunc(func(o *RegisterParams) {
+		o.OpCodeRange = append(o.OpCodeRange, OpCodeRange{Min: min, Max: max})
+	})
+}
+
+// Contains opcode 是否在范围内
+func (r OpCodeRange) Contains(opcode uint16) bool {
+	return opcode >= r.Min && opcode <= r.Max
+}
+
+// WithRegisterCodec 设置路由使用的编解码器
+func WithRegisterCodec(c codec.Codec) RegisterOptions {
+	return RegisterOptionFunc(func(o *RegisterParams) {
+		o.Codec = c
+	})
+}
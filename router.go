@@ -5,6 +5,10 @@ package lulu
 
 import (
 	"reflect"
+
+	"github.com/trainking/lulu/codec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const (
@@ -12,26 +16,77 @@ const (
 	OpCodeMax = 65535
 )
 
+const (
+	RouteKindHandle = "handle" // 外部路由，处理客户端请求
+	RouteKindInner  = "inner"  // 内部路由，通过 App.Call 触发
+	RouteKindSend   = "send"   // 返回路由，推送给客户端的消息
+)
+
 type (
 	// Router 路由结构
 	Router struct {
 		OpCode     uint16
+		Name       protoreflect.FullName
+		Kind       string                   // 路由的类型，handle, inner 或 send
+		Message    protoreflect.MessageType // 请求消息的类型，处理前按此类型解码
 		Handler    Handler
 		Middleware []Middleware
+		Codec      codec.Codec
+	}
+
+	// RouteGroup 路由分组，分组内的路由共享中间件、验证设置和 opcode 范围
+	RouteGroup struct {
+		r    *RouterManager
+		opts []RegisterOptions
+	}
+
+	// RouteInfo 路由表中的一条路由
+	RouteInfo struct {
+		OpCode     uint16                `json:"opcode"`
+		Name       protoreflect.FullName `json:"name"`
+		Kind       string                `json:"kind"`       // handle, inner 或 send
+		Middleware int                   `json:"middleware"` // 中间件数量，包含验证会话的中间件
 	}
 )
 
-// opcodeChange opcode的类型转换
+// opcodeChange opcode的类型转换，超出 OpCodeMin 到 OpCodeMax 范围的值视为错误
 func opcodeChange(opcode interface{}) (uint16, error) {
-	var _op uint16
-	var err error
+	if opcode == nil {
+		return 0, ErrOpCode
+	}
+
+	var v int64
 	switch reflect.TypeOf(opcode).Kind() {
-	case reflect.Int32, reflect.Int, reflect.Int64:
-		_op = uint16(reflect.ValueOf(opcode).Int())
-	case reflect.Uint, reflect.Uint16, reflect.Uint32:
-		_op = uint16(reflect.ValueOf(opcode).Uint())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int, reflect.Int64:
+		v = reflect.ValueOf(opcode).Int()
+	case reflect.Uint8, reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := reflect.ValueOf(opcode).Uint()
+		if u > OpCodeMax {
+			return 0, ErrOpCode
+		}
+		v = int64(u)
 	default:
-		err = ErrOpCode
+		return 0, ErrOpCode
+	}
+
+	if v < OpCodeMin || v > OpCodeMax {
+		return 0, ErrOpCode
 	}
-	return _op, err
+	return uint16(v), nil
+}
+
+// Register 在分组内注册路由，先应用分组的选项，再应用路由的选项
+func (g *RouteGroup) Register(msg proto.Message, opcode interface{}, opts ...RegisterOptions) error {
+	_opts := make([]RegisterOptions, 0, len(g.opts)+len(opts))
+	_opts = append(_opts, g.opts...)
+	_opts = append(_opts, opts...)
+	return g.r.Register(msg, opcode, _opts...)
+}
+
+// Group 创建子分组，继承此分组的选项
+func (g *RouteGroup) Group(opts ...RegisterOptions) *RouteGroup {
+	_opts := make([]RegisterOptions, 0, len(g.opts)+len(opts))
+	_opts = append(_opts, g.opts...)
+	_opts = append(_opts, opts...)
+	return &RouteGroup{r: g.r, opts: _opts}
 }
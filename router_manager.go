@@ -1,6 +1,10 @@
 package lulu
 
 import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/trainking/lulu/codec"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
@@ -10,7 +14,9 @@ type (
 	RouterManager struct {
 		handleRouter map[uint16]Router
 		innerRouter  map[protoreflect.FullName]Router
-		outSendMap   map[protoreflect.FullName]interface{}
+		outSendMap   map[protoreflect.FullName]Router
+		errs         []error                      // 注册失败的错误
+		reserved     map[string]map[uint16]string // 框架使用的 opcode 及其用途，按路由类型区分
 	}
 )
 
@@ -19,16 +25,61 @@ func NewRouterManager() *RouterManager {
 	return &RouterManager{
 		handleRouter: make(map[uint16]Router),
 		innerRouter:  make(map[protoreflect.FullName]Router),
-		outSendMap:   make(map[protoreflect.FullName]interface{}),
+		outSendMap:   make(map[protoreflect.FullName]Router),
+		reserved:     make(map[string]map[uint16]string),
+	}
+}
+
+// reserve 保留框架使用的 opcode，kind 类型的路由不能注册此 opcode
+func (r *RouterManager) reserve(kind string, opcode uint16, usage string) {
+	if r.reserved[kind] == nil {
+		r.reserved[kind] = make(map[uint16]string)
+	}
+	r.reserved[kind][opcode] = usage
+}
+
+// Register 注册路由；opcode 类型或取值错误、已被框架使用、同类路由的 opcode 或消息重复时，
+// 路由不会被注册，返回错误并记录在 Errors 中
+func (r *RouterManager) Register(msg proto.Message, opcode interface{}, opts ...RegisterOptions) error {
+	err := r.register(msg, opcode, opts...)
+	if err != nil {
+		r.errs = append(r.errs, err)
 	}
+	return err
 }
 
-// Register 注册路由
-func (r *RouterManager) Register(msg proto.Message, opcode interface{}, opts ...RegisterOptions) {
+// register 校验并注册路由
+func (r *RouterManager) register(msg proto.Message, opcode interface{}, opts ...RegisterOptions) error {
+	msgName := msg.ProtoReflect().Descriptor().FullName()
+	_op, err := opcodeChange(opcode)
+	if err != nil {
+		return errors.Wrapf(err, "%s: %v", msgName, opcode)
+	}
+
 	rp := NewRegisterParams(opts...)
+	for _, or := range rp.OpCodeRange {
+		if !or.Contains(_op) {
+			return errors.Wrapf(ErrOpCodeRange, "%s: %d not in [%d, %d]", msgName, _op, or.Min, or.Max)
+		}
+	}
+
 	if rp.Handler == nil {
-		r.outSendMap[msg.ProtoReflect().Descriptor().FullName()] = opcode
-		return
+		if usage, ok := r.reserved[RouteKindSend][_op]; ok {
+			return errors.Wrapf(ErrOpCodeReserved, "send %d: %s, %s", _op, usage, msgName)
+		}
+		if _, ok := r.outSendMap[msgName]; ok {
+			return errors.Wrapf(ErrDuplicateName, "send %s", msgName)
+		}
+		if _r, ok := r.GetSendRouter(_op); ok {
+			return errors.Wrapf(ErrDuplicateOpCode, "send %d: %s, %s", _op, _r.Name, msgName)
+		}
+		r.outSendMap[msgName] = Router{
+			OpCode: _op,
+			Name:   msgName,
+			Kind:   RouteKindSend,
+			Codec:  rp.Codec,
+		}
+		return nil
 	}
 
 	var m []Middleware
@@ -39,27 +90,54 @@ func (r *RouterManager) Register(msg proto.Message, opcode interface{}, opts ...
 	if len(rp.Middleware) > 0 {
 		m = append(m, rp.Middleware...)
 	}
+	router := Router{
+		OpCode:     _op,
+		Name:       msgName,
+		Kind:       RouteKindHandle,
+		Message:    msg.ProtoReflect().Type(),
+		Handler:    rp.Handler,
+		Middleware: m,
+		Codec:      rp.Codec,
+	}
+
 	if rp.IsInner {
-		_op, err := opcodeChange(opcode)
-		if err == ErrOpCode {
-			return
+		if _, ok := r.innerRouter[msgName]; ok {
+			return errors.Wrapf(ErrDuplicateName, "inner %s", msgName)
 		}
-		r.innerRouter[msg.ProtoReflect().Type().Descriptor().FullName()] = Router{
-			OpCode:     _op,
-			Handler:    rp.Handler,
-			Middleware: m,
+		for _, _r := range r.innerRouter {
+			if _r.OpCode == _op {
+				return errors.Wrapf(ErrDuplicateOpCode, "inner %d: %s, %s", _op, _r.Name, msgName)
+			}
 		}
-	} else {
-		_op, err := opcodeChange(opcode)
-		if err == ErrOpCode {
-			return
-		}
-		r.handleRouter[_op] = Router{
-			OpCode:     _op,
-			Handler:    rp.Handler,
-			Middleware: m,
+		router.Kind = RouteKindInner
+		r.innerRouter[msgName] = router
+		return nil
+	}
+
+	if usage, ok := r.reserved[RouteKindHandle][_op]; ok {
+		return errors.Wrapf(ErrOpCodeReserved, "handle %d: %s, %s", _op, usage, msgName)
+	}
+	if _r, ok := r.handleRouter[_op]; ok {
+		return errors.Wrapf(ErrDuplicateOpCode, "handle %d: %s, %s", _op, _r.Name, msgName)
+	}
+	for _, _r := range r.handleRouter {
+		if _r.Name == msgName {
+			return errors.Wrapf(ErrDuplicateName, "handle %s", msgName)
 		}
 	}
+	r.handleRouter[_op] = router
+	return nil
+}
+
+// Group 创建路由分组，opts 作用于分组内注册的每个路由，路由自己的选项在其后生效；
+// 分组设置的 opcode 范围不能被路由的选项覆盖
+func (r *RouterManager) Group(opts ...RegisterOptions) *RouteGroup {
+	return &RouteGroup{r: r, opts: opts}
+}
+
+// Errors 返回注册失败的路由错误
+func (r *RouterManager) Errors() []error {
+	return append([]error(nil), r.errs...)
 }
 
 // GetHandleRouter 获取请求处理路由
@@ -76,15 +154,11 @@ func (r *RouterManager) GetInnerRouter(msgName protoreflect.FullName) (Router, b
 
 // GetSendOpCode 获取返回消息对应的 opcode
 func (r *RouterManager) GetSendOpCode(msgName protoreflect.FullName) (uint16, bool) {
-	_op, ok := r.outSendMap[msgName]
+	_r, ok := r.outSendMap[msgName]
 	if !ok {
 		return 0, false
 	}
-	cd, err := opcodeChange(_op)
-	if err != nil {
-		return 0, false
-	}
-	return cd, true
+	return _r.OpCode, true
 }
 
 // GetMsgOpcode 获取消息对应的 opcode，只获取内部路由和返回消息
@@ -94,13 +168,54 @@ func (r *RouterManager) GetMsgOpcode(msg proto.Message) (uint16, error) {
 		return _router.OpCode, nil
 	}
 
-	if opcode, ok := r.outSendMap[msgName]; ok {
-		cd, err := opcodeChange(opcode)
-		if err != nil {
-			return 0, err
-		}
-		return cd, nil
+	if _router, ok := r.outSendMap[msgName]; ok {
+		return _router.OpCode, nil
 	}
 
 	return 0, ErrNoRegister
 }
+
+// GetMsgCodec 获取消息对应路由设置的编解码器，只获取内部路由和返回消息；未设置时返回 nil
+func (r *RouterManager) GetMsgCodec(msgName protoreflect.FullName) codec.Codec {
+	if _router, ok := r.innerRouter[msgName]; ok {
+		return _router.Codec
+	}
+
+	if _router, ok := r.outSendMap[msgName]; ok {
+		return _router.Codec
+	}
+
+	return nil
+}
+
+// GetSendRouter 通过 opcode 获取返回路由
+func (r *RouterManager) GetSendRouter(opcode uint16) (Router, bool) {
+	for _, _r := range r.outSendMap {
+		if _r.OpCode == opcode {
+			return _r, true
+		}
+	}
+	return Router{}, false
+}
+
+// Routes 返回所有路由，按 opcode 排序
+func (r *RouterManager) Routes() []RouteInfo {
+	routes := make([]RouteInfo, 0, len(r.handleRouter)+len(r.innerRouter)+len(r.outSendMap))
+	for _, _r := range r.handleRouter {
+		routes = append(routes, RouteInfo{OpCode: _r.OpCode, Name: _r.Name, Kind: _r.Kind, Middleware: len(_r.Middleware)})
+	}
+	for _, _r := range r.innerRouter {
+		routes = append(routes, RouteInfo{OpCode: _r.OpCode, Name: _r.Name, Kind: _r.Kind, Middleware: len(_r.Middleware)})
+	}
+	for _, _r := range r.outSendMap {
+		routes = append(routes, RouteInfo{OpCode: _r.OpCode, Name: _r.Name, Kind: _r.Kind})
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].OpCode != routes[j].OpCode {
+			return routes[i].OpCode < routes[j].OpCode
+		}
+		return routes[i].Kind < routes[j].Kind
+	})
+	return routes
+}
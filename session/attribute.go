@@ -0,0 +1,118 @@
+package session
+
+// Set 设置会话属性，会话销毁时清空，会话恢复后保留
+func (s *Session) Set(key string, value interface{}) {
+	s.attrsMu.Lock()
+	defer s.attrsMu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// Get 获取会话属性
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.attrsMu.RLock()
+	defer s.attrsMu.RUnlock()
+	v, ok := s.attrs[key]
+	return v, ok
+}
+
+// Delete 删除会话属性
+func (s *Session) Delete(key string) {
+	s.attrsMu.Lock()
+	defer s.attrsMu.Unlock()
+	delete(s.attrs, key)
+}
+
+// LoadOrStore 获取会话属性，不存在时设置为 value；loaded 为 true 表示属性已存在
+func (s *Session) LoadOrStore(key string, value interface{}) (actual interface{}, loaded bool) {
+	s.attrsMu.Lock()
+	defer s.attrsMu.Unlock()
+	if v, ok := s.attrs[key]; ok {
+		return v, true
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+	return value, false
+}
+
+// Range 遍历会话属性，f 返回 false 时停止遍历；f 中不能修改会话属性
+func (s *Session) Range(f func(key string, value interface{}) bool) {
+	s.attrsMu.RLock()
+	defer s.attrsMu.RUnlock()
+	for k, v := range s.attrs {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// GetString 获取 string 类型的会话属性，不存在或类型不匹配时返回 false
+func (s *Session) GetString(key string) (string, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return "", false
+	}
+	r, ok := v.(string)
+	return r, ok
+}
+
+// GetInt 获取 int 类型的会话属性，不存在或类型不匹配时返回 false
+func (s *Session) GetInt(key string) (int, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return 0, false
+	}
+	r, ok := v.(int)
+	return r, ok
+}
+
+// GetInt64 获取 int64 类型的会话属性，不存在或类型不匹配时返回 false
+func (s *Session) GetInt64(key string) (int64, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return 0, false
+	}
+	r, ok := v.(int64)
+	return r, ok
+}
+
+// GetUint64 获取 uint64 类型的会话属性，不存在或类型不匹配时返回 false
+func (s *Session) GetUint64(key string) (uint64, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return 0, false
+	}
+	r, ok := v.(uint64)
+	return r, ok
+}
+
+// GetBool 获取 bool 类型的会话属性，不存在或类型不匹配时返回 false
+func (s *Session) GetBool(key string) (bool, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return false, false
+	}
+	r, ok := v.(bool)
+	return r, ok
+}
+
+// GetFloat64 获取 float64 类型的会话属性，不存在或类型不匹配时返回 false
+func (s *Session) GetFloat64(key string) (float64, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		return 0, false
+	}
+	r, ok := v.(float64)
+	return r, ok
+}
+
+// clearAttrs 清空会话属性
+func (s *Session) clearAttrs() {
+	s.attrsMu.Lock()
+	defer s.attrsMu.Unlock()
+	s.attrs = nil
+}
@@ -0,0 +1,165 @@
+package session
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/trainking/lulu/network"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// ErrGroupDestroyed 分组已销毁
+	ErrGroupDestroyed = errors.New("group destroyed")
+
+	// ErrNoGroup 分组不存在
+	ErrNoGroup = errors.New("no group")
+
+	// ErrSessionClosed 会话已关闭
+	ErrSessionClosed = errors.New("session closed")
+)
+
+type (
+	// Group 会话分组，用于房间、公会频道等需要广播的场景；会话销毁时自动离开所有分组
+	Group struct {
+		name      string
+		members   map[*Session]struct{}
+		destroyed bool
+		mu        sync.RWMutex
+	}
+)
+
+// newGroup 创建分组
+func newGroup(name string) *Group {
+	return &Group{
+		name:    name,
+		members: make(map[*Session]struct{}),
+	}
+}
+
+// Name 分组的名字
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Join 会话加入分组
+func (g *Group) Join(s *Session) error {
+	// 持有会话锁加入，避免与会话销毁并发时残留在分组中
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+
+	g.mu.Lock()
+	if g.destroyed {
+		g.mu.Unlock()
+		return ErrGroupDestroyed
+	}
+	g.members[s] = struct{}{}
+	g.mu.Unlock()
+
+	if s.groups == nil {
+		s.groups = make(map[*Group]struct{})
+	}
+	s.groups[g] = struct{}{}
+	return nil
+}
+
+// Leave 会话离开分组
+func (g *Group) Leave(s *Session) {
+	s.mu.Lock()
+	delete(s.groups, g)
+	s.mu.Unlock()
+
+	g.remove(s)
+}
+
+// remove 从分组中移除会话
+func (g *Group) remove(s *Session) {
+	g.mu.Lock()
+	delete(g.members, s)
+	g.mu.Unlock()
+}
+
+// Has 会话是否在分组中
+func (g *Group) Has(s *Session) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.members[s]
+	return ok
+}
+
+// Len 分组的成员数量
+func (g *Group) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.members)
+}
+
+// Members 分组成员的快照
+func (g *Group) Members() []*Session {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	members := make([]*Session, 0, len(g.members))
+	for s := range g.members {
+		members = append(members, s)
+	}
+	return members
+}
+
+// Broadcast 向分组的所有成员广播消息，exclude 为不需要接收的 UserID；
+// 消息只编码一次，同一个报文写入每个成员的连接，单个成员写入失败不影响其他成员
+func (g *Group) Broadcast(msg proto.Message, exclude ...uint64) error {
+	return broadcast(g.Members(), msg, func(s *Session) bool {
+		return !isExclude(s.GetUserID(), exclude)
+	})
+}
+
+// destroy 销毁分组，所有成员离开
+func (g *Group) destroy() {
+	g.mu.Lock()
+	g.destroyed = true
+	members := g.members
+	g.members = make(map[*Session]struct{})
+	g.mu.Unlock()
+
+	for s := range members {
+		s.mu.Lock()
+		delete(s.groups, g)
+		s.mu.Unlock()
+	}
+}
+
+// broadcast 向 filter 返回 true 的会话广播消息，消息只编码一次
+func broadcast(sessions []*Session, msg proto.Message, filter func(*Session) bool) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	// 同一个管理器中的会话共享回调，使用任意一个会话编码即可
+	p, err := sessions[0].packing(0, msg)
+	if err != nil {
+		return err
+	}
+	// 开启压缩的连接共享压缩的结果，每种压缩算法只压缩一次
+	bp := network.NewBroadcastPacket(p)
+
+	for _, s := range sessions {
+		if filter != nil && !filter(s) {
+			continue
+		}
+		s.WritePacket(bp)
+	}
+	return nil
+}
+
+// isExclude userID 是否在排除列表中
+func isExclude(userID uint64, exclude []uint64) bool {
+	for _, id := range exclude {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
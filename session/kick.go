@@ -0,0 +1,61 @@
+package session
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/trainking/lulu/network"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	KickReasonNone         KickReason = iota // 未指定原因
+	KickReasonDuplicate                      // 重复登录，被新的会话顶替
+	KickReasonBan                            // 账号被封禁
+	KickReasonFlood                          // 消息频率超过限制
+	KickReasonValidTimeout                   // 连接后未在规定时间内验证身份
+	KickReasonShutdown                       // 服务器关闭
+	KickReasonServer                         // 服务端主动踢出，如运维操作
+	KickReasonResumed                        // 会话已在新的连接上恢复，旧连接被关闭
+)
+
+// ErrKickPacket 断开通知报文格式错误
+var ErrKickPacket = errors.New("wrong kick packet")
+
+// KickReason 踢出的原因码，业务可在 KickReasonResumed 之后自定义原因码
+type KickReason uint16
+
+// Kick 向客户端发送断开通知后销毁会话；断开通知的包体为 2 字节的原因码，
+// 后跟可选的 msg 编码
+func (s *Session) Kick(reason KickReason, msg proto.Message) error {
+	defer s.Destroy()
+
+	p, err := s.kickPacket(reason, msg)
+	if err != nil {
+		return err
+	}
+	return s.WritePacket(p)
+}
+
+// kickPacket 生成断开通知报文
+func (s *Session) kickPacket(reason KickReason, msg proto.Message) (network.Packet, error) {
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, uint16(reason))
+	if msg != nil {
+		msgB, err := s.callback.GetMsgCodec(msg).Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, msgB...)
+	}
+
+	return network.PackingOpcode(s.callback.GetKickOpCode(), body), nil
+}
+
+// ParseKick 解析断开通知报文的包体，返回原因码和附带消息的编码
+func ParseKick(body []byte) (KickReason, []byte, error) {
+	if len(body) < 2 {
+		return KickReasonNone, nil, ErrKickPacket
+	}
+	return KickReason(binary.BigEndian.Uint16(body[:2])), body[2:], nil
+}
@@ -1,28 +1,57 @@
 package session
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/trainking/lulu/codec"
+	"github.com/trainking/lulu/logger"
 	"github.com/trainking/lulu/network"
 	"google.golang.org/protobuf/proto"
 )
 
+var (
+	// ErrSessionNotResumable 会话已销毁或未开启恢复
+	ErrSessionNotResumable = errors.New("session not resumable")
+
+	// ErrResumeToken 无效的恢复令牌
+	ErrResumeToken = errors.New("invalid resume token")
+)
+
 type (
 	// Session 会话，会话是对玩家连接的一个包装
 	Session struct {
 		ID     int64        // 会话 ID， 唯一标识
-		Conn   network.Conn // 会话连接
+		Conn   network.Conn // 会话连接，会话恢复时会替换为新的连接
 		UserID uint64       // 用户 ID
 
+		device atomic.Value // 设备标识，多设备登录策略下区分同一玩家的会话
+
 		callback  SessionCallback // 回调接口
 		closeChan chan struct{}   // 关闭信号
 		closeOnce sync.Once       // 控制关闭单例
 		validChan chan uint64     // 验证通过信号
 		lastTick  int64           // 最后一次计数刷新时间 (Unix 秒)
 		msgCount  int32           // 当前周期的消息计数
+		replaced  int32           // 是否已被新会话顶替，顶替后不再处理新的请求
+
+		mu            sync.Mutex          // 保护连接替换和断线状态
+		closed        bool                // 是否已销毁
+		detached      bool                // 是否处于断线等待恢复的状态
+		token         string              // 恢复令牌，为空时不可恢复
+		resumeOpCode  uint16              // 下发恢复令牌使用的 opcode
+		resumeTimeout time.Duration       // 断线后等待恢复的宽限期
+		expireTimer   *time.Timer         // 宽限期计时器
+		pending       []network.Packet    // 断线期间待发送的消息
+		pendingMax    int                 // 断线期间最多缓存的消息数量
+		groups        map[*Group]struct{} // 加入的分组
+
+		attrs   map[string]interface{} // 会话属性
+		attrsMu sync.RWMutex           // 保护会话属性的并发访问
 	}
 
 	// SessionCallback 会话回调接口
@@ -36,8 +65,20 @@ type (
 		// OnDisconnect 当连接断开时
 		OnDisconnect(*Session)
 
+		// OnDetach 当可恢复的会话断线，进入等待恢复的状态时
+		OnDetach(*Session)
+
 		// GetMsgOpCode 获取消息的 OpCode
 		GetMsgOpCode(msg proto.Message) (uint16, error)
+
+		// GetMsgCodec 获取消息的编解码器
+		GetMsgCodec(msg proto.Message) codec.Codec
+
+		// GetKickOpCode 获取断开通知使用的 opcode
+		GetKickOpCode() uint16
+
+		// GetLogger 获取会话使用的日志
+		GetLogger() logger.Logger
 	}
 )
 
@@ -54,11 +95,15 @@ func NewSession(conn network.Conn, callback SessionCallback) *Session {
 
 // Run 运行会话
 func (s *Session) Run() {
+	s.mu.Lock()
+	conn := s.Conn
+	s.mu.Unlock()
+
 	defer func() {
 		if e := recover(); e != nil {
-			fmt.Printf("read loop error: %v\n", e)
+			s.callback.GetLogger().Error("session read loop panic", append(s.LogFields(), logger.Any("panic", e))...)
 		}
-		s.Destroy()
+		s.disconnect(conn)
 	}()
 
 	for {
@@ -68,34 +113,108 @@ func (s *Session) Run() {
 		default:
 		}
 
-		p, err := s.Conn.ReadPacket()
+		p, err := conn.ReadPacket()
 		if err != nil {
 			return
 		}
+		if atomic.LoadInt32(&s.replaced) == 1 {
+			p.Free()
+			continue
+		}
 
 		s.callback.OnMessage(s, p)
 	}
 }
 
-// SetUserID 设置用户 ID
+// RemoteIP 当前连接的对端 IP
+func (s *Session) RemoteIP() string {
+	s.mu.Lock()
+	conn := s.Conn
+	s.mu.Unlock()
+
+	return conn.GetRealIP()
+}
+
+// LogFields 返回标识此会话的日志字段：session_id，user_id，remote_ip
+func (s *Session) LogFields() []logger.Field {
+	return []logger.Field{
+		logger.Any(logger.KeySessionID, s.ID),
+		logger.Uint64(logger.KeyUserID, s.GetUserID()),
+		logger.String(logger.KeyRemoteIP, s.RemoteIP()),
+	}
+}
+
+// disconnect 读取连接结束；可恢复的会话进入断线状态，否则销毁会话
+func (s *Session) disconnect(conn network.Conn) {
+	s.mu.Lock()
+	if s.closed || s.Conn != conn {
+		// 会话已销毁，或连接已经移交
+		s.mu.Unlock()
+		return
+	}
+	if s.token == "" {
+		s.mu.Unlock()
+		s.Destroy()
+		return
+	}
+	s.detach(conn)
+	s.mu.Unlock()
+}
+
+// detach 关闭当前连接，进入断线等待恢复的状态，宽限期结束后销毁会话；调用时需持有 s.mu
+func (s *Session) detach(conn network.Conn) {
+	s.detached = true
+	s.expireTimer = time.AfterFunc(s.resumeTimeout, s.expire)
+
+	conn.Close()
+	s.callback.OnDetach(s)
+}
+
+// SetUserID 设置用户 ID，标记会话验证通过；只有第一次设置生效
 func (s *Session) SetUserID(userID uint64) {
+	if userID == 0 || !atomic.CompareAndSwapUint64(&s.UserID, 0, userID) {
+		return
+	}
+
+	// 先设置 UserID 再通知，等待验证的协程读取到的 UserID 一定已经设置
 	select {
 	case s.validChan <- userID:
-		s.UserID = userID
 	case <-s.closeChan:
 		// session 已关闭，不再需要验证
 		return
 	}
 }
 
+// SetDevice 设置会话的设备标识，需要在 SetUserID 之前设置；
+// DuplicateMultiDevice 策略下，同一玩家不同设备的会话可以同时在线
+func (s *Session) SetDevice(device string) {
+	s.device.Store(device)
+}
+
+// Device 获取会话的设备标识，未设置时为空
+func (s *Session) Device() string {
+	device, _ := s.device.Load().(string)
+	return device
+}
+
 // WaitValid 等待验证
 func (s *Session) WaitValid() <-chan uint64 {
 	return s.validChan
 }
 
+// Done 返回会话关闭的通知 channel
+func (s *Session) Done() <-chan struct{} {
+	return s.closeChan
+}
+
+// GetUserID 获取用户 ID，未验证时为 0
+func (s *Session) GetUserID() uint64 {
+	return atomic.LoadUint64(&s.UserID)
+}
+
 // IsValid 是否有效
 func (s *Session) IsValid() bool {
-	return s.UserID != 0
+	return s.GetUserID() != 0
 }
 
 // CheckFlood 检查是否洪水攻击，每分钟超过 limit 返回 true
@@ -116,25 +235,220 @@ func (s *Session) CheckFlood(limit int) bool {
 
 // Send 向此 session 推送消息
 func (s *Session) Send(msg proto.Message) error {
-	opcode, err := s.callback.GetMsgOpCode(msg)
+	return s.Reply(0, msg)
+}
+
+// Reply 向此 session 回复请求，seq 为请求的序列号，为 0 时等同于 Send
+func (s *Session) Reply(seq uint32, msg proto.Message) error {
+	pakcket, err := s.packing(seq, msg)
 	if err != nil {
 		return err
 	}
+	return s.WritePacket(pakcket)
+}
 
-	msgB, err := proto.Marshal(msg)
+// packing 将消息编码为报文
+func (s *Session) packing(seq uint32, msg proto.Message) (network.Packet, error) {
+	opcode, err := s.callback.GetMsgOpCode(msg)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	msgB, err := s.callback.GetMsgCodec(msg).Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if seq != 0 {
+		return network.PackingSeqOpcode(opcode, seq, msgB), nil
+	}
+	return network.PackingOpcode(opcode, msgB), nil
+}
+
+// WritePacket 向此 session 写入报文；断线等待恢复期间，报文会被缓存，恢复后补发
+func (s *Session) WritePacket(p network.Packet) error {
+	s.mu.Lock()
+	if s.detached {
+		// 超出缓存上限时，丢弃最早的消息
+		if s.pendingMax > 0 && len(s.pending) >= s.pendingMax {
+			s.pending = s.pending[1:]
+		}
+		s.pending = append(s.pending, p)
+		s.mu.Unlock()
+		return nil
+	}
+	conn := s.Conn
+	s.mu.Unlock()
+
+	return conn.WritePacket(p)
+}
+
+// AcceptCompressor 按客户端支持的压缩算法编号协商当前连接的压缩算法，之后接受此算法压缩的报文，返回此算法；
+// 连接不支持协商或未启用压缩时返回 nil。会话恢复后使用新的连接，需要重新协商
+func (s *Session) AcceptCompressor(ids []byte) network.Compressor {
+	s.mu.Lock()
+	conn := s.Conn
+	s.mu.Unlock()
+
+	if cc, ok := conn.(network.CompressConn); ok {
+		return cc.AcceptCompressor(ids)
 	}
+	return nil
+}
+
+// ActivateCompressor 当前连接之后发送的报文使用协商的压缩算法，需要在回复协商结果之后调用
+func (s *Session) ActivateCompressor() {
+	s.mu.Lock()
+	conn := s.Conn
+	s.mu.Unlock()
 
-	pakcket := network.PackingOpcode(opcode, msgB)
-	return s.Conn.WritePacket(pakcket)
+	if cc, ok := conn.(network.CompressConn); ok {
+		cc.ActivateCompressor()
+	}
+}
+
+// EnableResume 开启会话恢复，生成恢复令牌并通过 opcode 下发给客户端；
+// 断线后会话保留 timeout 的时间等待恢复，期间最多缓存 pendingMax 条消息
+func (s *Session) EnableResume(opcode uint16, timeout time.Duration, pendingMax int) error {
+	s.mu.Lock()
+	s.token = newResumeToken()
+	s.resumeOpCode = opcode
+	s.resumeTimeout = timeout
+	s.pendingMax = pendingMax
+	conn := s.Conn
+	p := network.PackingOpcode(opcode, []byte(s.token))
+	s.mu.Unlock()
+
+	return conn.WritePacket(p)
+}
+
+// ResumeToken 获取恢复令牌，未开启会话恢复时为空
+func (s *Session) ResumeToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// IsDetached 是否处于断线等待恢复的状态
+func (s *Session) IsDetached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.detached
+}
+
+// Resume 使用 from 的连接恢复此会话；from 是新连接上尚未验证的临时会话，
+// 恢复后 from 不再可用。旧连接尚未断开时，以 KickReasonResumed 通知后关闭。
+// 恢复成功会轮换令牌，并先下发新令牌再补发缓存的消息
+func (s *Session) Resume(from *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.token == "" {
+		return ErrSessionNotResumable
+	}
+
+	conn, ok := from.handOff()
+	if !ok {
+		return ErrSessionNotResumable
+	}
+
+	// 旧连接可能还未检测到断开，通知旧连接的客户端后关闭
+	if !s.detached {
+		if p, err := s.kickPacket(KickReasonResumed, nil); err == nil {
+			s.Conn.WritePacket(p)
+		}
+		s.detach(s.Conn)
+	}
+	s.expireTimer.Stop()
+
+	s.Conn = conn
+	s.detached = false
+	s.token = newResumeToken()
+
+	pending := s.pending
+	s.pending = nil
+
+	// 持有锁补发，保证恢复后新的消息排在缓存消息之后
+	if err := conn.WritePacket(network.PackingOpcode(s.resumeOpCode, []byte(s.token))); err == nil {
+		for _, p := range pending {
+			if err := conn.WritePacket(p); err != nil {
+				break
+			}
+		}
+	}
+
+	go s.Run()
+	return nil
+}
+
+// expire 断线宽限期结束，仍未恢复的会话将被销毁
+func (s *Session) expire() {
+	s.mu.Lock()
+	if !s.detached || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	// 提前标记，避免销毁过程中被恢复
+	s.closed = true
+	s.mu.Unlock()
+
+	s.destroy()
+}
+
+// handOff 将连接移交给其他会话，此会话关闭但不关闭连接，也不触发断开回调
+func (s *Session) handOff() (network.Conn, bool) {
+	var conn network.Conn
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		conn = s.Conn
+		s.mu.Unlock()
+		close(s.closeChan)
+	})
+	return conn, conn != nil
 }
 
 // Destroy 销毁会话
 func (s *Session) Destroy() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.destroy()
+}
+
+// destroy 关闭连接并触发断开回调
+func (s *Session) destroy() {
 	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.pending = nil
+		if s.expireTimer != nil {
+			s.expireTimer.Stop()
+		}
+		conn := s.Conn
+		groups := s.groups
+		s.groups = nil
+		s.mu.Unlock()
+
+		// 离开所有分组
+		for g := range groups {
+			g.remove(s)
+		}
+
 		close(s.closeChan)
-		s.Conn.Close()
+		conn.Close()
 		s.callback.OnDisconnect(s)
+
+		// 断开回调之后再清空，回调中仍可读取会话属性做清理
+		s.clearAttrs()
 	})
 }
+
+// newResumeToken 生成随机的恢复令牌
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,22 +1,57 @@
 package session
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DuplicateKickOld     DuplicatePolicy = "kick_old"     // 踢掉旧会话，新会话顶替；默认策略
+	DuplicateRejectNew   DuplicatePolicy = "reject_new"   // 保留旧会话，拒绝新会话
+	DuplicateMultiDevice DuplicatePolicy = "multi_device" // 不同设备的会话可以同时在线，同一设备踢掉旧会话
+)
+
+// DefaultMaxUserSessions 默认每个玩家同时在线的最大会话数
+const DefaultMaxUserSessions = 5
 
 type (
+	// DuplicatePolicy 同一玩家重复登录时的处理策略
+	DuplicatePolicy string
+
+	// ReplaceHandler 旧会话被新会话顶替时的回调，用于将旧会话的状态迁移到新会话
+	ReplaceHandler func(old, new *Session)
+
 	// SessionManager 会话管理器
 	SessionManager struct {
-		sessions    map[uint64]*Session // 有效会话的集合，key：userID
+		sessions    map[uint64][]*Session // 有效会话的集合，key：userID；按加入的顺序排列
+		count       int                   // 有效会话的数量
+		tokens      map[string]*Session   // 可恢复会话的集合，key：恢复令牌
+		policy      DuplicatePolicy       // 重复登录的处理策略
+		maxSessions int                   // 每个玩家同时在线的最大会话数
+		onReplace   ReplaceHandler        // 旧会话被顶替时的回调
+		replacing   map[uint64][]*Session // 正在迁移状态的玩家，value：迁移期间等待加入的会话
 		sessionsAdd chan *Session
 		sessionsDel chan *Session
 		closeChan   chan struct{}
+		closeOnce   sync.Once
 		mu          sync.RWMutex // 保护 sessions 的并发访问
+
+		groups   map[string]*Group // 分组的集合，key：分组名
+		groupsMu sync.RWMutex      // 保护 groups 的并发访问
 	}
 )
 
 // NewSessionManager 创建一个会话管理器
 func NewSessionManager() *SessionManager {
 	mgr := &SessionManager{
-		sessions:    make(map[uint64]*Session),
+		sessions:    make(map[uint64][]*Session),
+		tokens:      make(map[string]*Session),
+		replacing:   make(map[uint64][]*Session),
+		policy:      DuplicateKickOld,
+		maxSessions: DefaultMaxUserSessions,
+		groups:      make(map[string]*Group),
 		sessionsAdd: make(chan *Session),
 		sessionsDel: make(chan *Session),
 		closeChan:   make(chan struct{}),
@@ -27,6 +62,38 @@ func NewSessionManager() *SessionManager {
 	return mgr
 }
 
+// SetDuplicatePolicy 设置重复登录的处理策略，未知的策略按 DuplicateKickOld 处理
+func (mgr *SessionManager) SetDuplicatePolicy(policy DuplicatePolicy) {
+	switch policy {
+	case DuplicateRejectNew, DuplicateMultiDevice:
+	default:
+		policy = DuplicateKickOld
+	}
+
+	mgr.mu.Lock()
+	mgr.policy = policy
+	mgr.mu.Unlock()
+}
+
+// SetMaxSessions 设置每个玩家同时在线的最大会话数，多设备登录时超出后踢掉最早登录的会话；n 不大于 0 时使用默认值
+func (mgr *SessionManager) SetMaxSessions(n int) {
+	if n <= 0 {
+		n = DefaultMaxUserSessions
+	}
+
+	mgr.mu.Lock()
+	mgr.maxSessions = n
+	mgr.mu.Unlock()
+}
+
+// SetReplaceHandler 设置旧会话被新会话顶替时的回调；回调在独立的协程中执行，执行前旧会话已移出会话管理器，
+// 并停止处理新的请求，执行完成后新会话才加入会话管理器，旧会话随后被踢出，可以安全地读取旧会话的属性
+func (mgr *SessionManager) SetReplaceHandler(h ReplaceHandler) {
+	mgr.mu.Lock()
+	mgr.onReplace = h
+	mgr.mu.Unlock()
+}
+
 // handle 处理会话管理器
 func (mgr *SessionManager) handle() {
 	for {
@@ -34,44 +101,341 @@ func (mgr *SessionManager) handle() {
 		case <-mgr.closeChan:
 			return
 		case s := <-mgr.sessionsAdd:
-			mgr.mu.Lock()
-			if oldSession, ok := mgr.sessions[s.UserID]; ok {
-				oldSession.Destroy()
-			}
-			mgr.sessions[s.UserID] = s
-			mgr.mu.Unlock()
+			mgr.add(s)
 		case s := <-mgr.sessionsDel:
 			mgr.mu.Lock()
-			if _session, ok := mgr.sessions[s.UserID]; ok && _session.ID == s.ID {
-				delete(mgr.sessions, s.UserID)
-				_session.Destroy()
+			if mgr.remove(s) {
+				s.Destroy()
 			}
 			mgr.mu.Unlock()
 		}
 	}
 }
 
-// Add 增加会话，进入会话管理器
+// add 按重复登录策略加入会话；踢出会触发 Del，需要在其他协程中执行，避免阻塞管理器
+func (mgr *SessionManager) add(s *Session) {
+	select {
+	case <-s.closeChan:
+		// 会话已销毁，Del 已经发出或处理，不能再加入
+		return
+	default:
+	}
+
+	mgr.mu.Lock()
+	if waiting, ok := mgr.replacing[s.UserID]; ok {
+		// 同一玩家正在迁移状态，迁移完成后再加入
+		mgr.replacing[s.UserID] = append(waiting, s)
+		mgr.mu.Unlock()
+		return
+	}
+	old := mgr.duplicate(s.UserID, s.Device())
+	if old == s {
+		mgr.mu.Unlock()
+		return
+	}
+	if old != nil && mgr.policy == DuplicateRejectNew {
+		mgr.mu.Unlock()
+		go s.Kick(KickReasonDuplicate, nil)
+		return
+	}
+	if old != nil {
+		mgr.remove(old)
+	}
+	if old != nil && mgr.onReplace != nil {
+		// 旧会话停止处理新的请求，迁移完成之前新会话不加入会话管理器
+		atomic.StoreInt32(&old.replaced, 1)
+		mgr.replacing[s.UserID] = nil
+		mgr.mu.Unlock()
+		go mgr.replace(old, s, mgr.onReplace)
+		return
+	}
+	evicted := mgr.insert(s)
+	mgr.mu.Unlock()
+
+	if old != nil {
+		evicted = append(evicted, old)
+	}
+	for _, e := range evicted {
+		go e.Kick(KickReasonDuplicate, nil)
+	}
+}
+
+// replace 执行状态迁移的回调，完成后新会话加入会话管理器，踢掉旧会话，再加入迁移期间等待的会话
+func (mgr *SessionManager) replace(old, s *Session, onReplace ReplaceHandler) {
+	onReplace(old, s)
+
+	mgr.mu.Lock()
+	waiting := mgr.replacing[s.UserID]
+	delete(mgr.replacing, s.UserID)
+	var evicted []*Session
+	select {
+	case <-s.closeChan:
+		// 新会话在迁移期间已断开
+	case <-mgr.closeChan:
+		// 会话管理器已关闭，Close 不会踢掉还未加入的会话
+		defer s.Kick(KickReasonShutdown, nil)
+	default:
+		evicted = mgr.insert(s)
+	}
+	mgr.mu.Unlock()
+
+	old.Kick(KickReasonDuplicate, nil)
+	for _, e := range evicted {
+		e.Kick(KickReasonDuplicate, nil)
+	}
+	for _, w := range waiting {
+		mgr.Add(w)
+	}
+}
+
+// insert 将会话加入会话集合，玩家的会话数超出上限时移除最早登录的会话并返回，由调用者踢出；需要持有锁调用
+func (mgr *SessionManager) insert(s *Session) []*Session {
+	var evicted []*Session
+	for len(mgr.sessions[s.UserID]) >= mgr.maxSessions {
+		e := mgr.sessions[s.UserID][0]
+		mgr.remove(e)
+		evicted = append(evicted, e)
+	}
+
+	mgr.sessions[s.UserID] = append(mgr.sessions[s.UserID], s)
+	mgr.count++
+	if token := s.ResumeToken(); token != "" {
+		mgr.tokens[token] = s
+	}
+	return evicted
+}
+
+// duplicate 返回与 userID 和 device 冲突的会话；多设备策略下只有同一设备的会话冲突，需要持有锁调用
+func (mgr *SessionManager) duplicate(userID uint64, device string) *Session {
+	for _, s := range mgr.sessions[userID] {
+		if mgr.policy != DuplicateMultiDevice || s.Device() == device {
+			return s
+		}
+	}
+	return nil
+}
+
+// remove 从会话集合中移除会话，返回会话是否存在；需要持有锁调用
+func (mgr *SessionManager) remove(s *Session) bool {
+	sessions := mgr.sessions[s.UserID]
+	for i, _session := range sessions {
+		if _session.ID != s.ID {
+			continue
+		}
+		if len(sessions) == 1 {
+			delete(mgr.sessions, s.UserID)
+		} else {
+			mgr.sessions[s.UserID] = append(sessions[:i:i], sessions[i+1:]...)
+		}
+		delete(mgr.tokens, _session.ResumeToken())
+		mgr.count--
+		return true
+	}
+	return false
+}
+
+// Admit 是否接受 userID 在 device 上的新会话；只有 DuplicateRejectNew 策略下已有会话时返回 false，
+// 可以在设置 UserID 之前调用，提前拒绝登录
+func (mgr *SessionManager) Admit(userID uint64, device string) bool {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	return mgr.policy != DuplicateRejectNew || mgr.duplicate(userID, device) == nil
+}
+
+// Add 增加会话，进入会话管理器；管理器关闭后直接销毁会话
 func (mgr *SessionManager) Add(s *Session) {
-	mgr.sessionsAdd <- s
+	select {
+	case mgr.sessionsAdd <- s:
+	case <-mgr.closeChan:
+		s.Destroy()
+	}
 }
 
 // Del 删除会话，从会话管理器中删除
 func (mgr *SessionManager) Del(s *Session) {
-	mgr.sessionsDel <- s
+	select {
+	case mgr.sessionsDel <- s:
+	case <-mgr.closeChan:
+	}
 }
 
-// Get 获取玩家的会话
+// Get 获取玩家的会话；多设备同时在线时返回最后登录的会话
 func (mgr *SessionManager) Get(userID uint64) (*Session, bool) {
 	mgr.mu.RLock()
 	defer mgr.mu.RUnlock()
-	s, ok := mgr.sessions[userID]
-	return s, ok
+	sessions := mgr.sessions[userID]
+	if len(sessions) == 0 {
+		return nil, false
+	}
+	return sessions[len(sessions)-1], true
+}
+
+// GetAll 获取玩家所有的会话，按登录的顺序排列
+func (mgr *SessionManager) GetAll(userID uint64) []*Session {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	return append([]*Session(nil), mgr.sessions[userID]...)
+}
+
+// GetDevice 获取玩家在 device 上的会话
+func (mgr *SessionManager) GetDevice(userID uint64, device string) (*Session, bool) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	for _, s := range mgr.sessions[userID] {
+		if s.Device() == device {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Resume 通过恢复令牌，使用 from 的连接恢复断线的会话；恢复后令牌会轮换，旧令牌失效
+func (mgr *SessionManager) Resume(token string, from *Session) (*Session, error) {
+	mgr.mu.Lock()
+	s, ok := mgr.tokens[token]
+	if ok {
+		delete(mgr.tokens, token)
+	}
+	mgr.mu.Unlock()
+	if !ok {
+		return nil, ErrResumeToken
+	}
+
+	if err := s.Resume(from); err != nil {
+		return nil, err
+	}
+
+	mgr.mu.Lock()
+	for _, _session := range mgr.sessions[s.UserID] {
+		if _session == s {
+			mgr.tokens[s.ResumeToken()] = s
+			break
+		}
+	}
+	mgr.mu.Unlock()
+
+	return s, nil
 }
 
 // Len 返回当前会话的数量
 func (mgr *SessionManager) Len() int {
 	mgr.mu.RLock()
 	defer mgr.mu.RUnlock()
-	return len(mgr.sessions)
+	return mgr.count
+}
+
+// CreateGroup 创建分组，分组已存在时返回已有的分组
+func (mgr *SessionManager) CreateGroup(name string) *Group {
+	mgr.groupsMu.Lock()
+	defer mgr.groupsMu.Unlock()
+	if g, ok := mgr.groups[name]; ok {
+		return g
+	}
+	g := newGroup(name)
+	mgr.groups[name] = g
+	return g
+}
+
+// DestroyGroup 销毁分组，所有成员离开分组
+func (mgr *SessionManager) DestroyGroup(name string) {
+	mgr.groupsMu.Lock()
+	g, ok := mgr.groups[name]
+	delete(mgr.groups, name)
+	mgr.groupsMu.Unlock()
+
+	if ok {
+		g.destroy()
+	}
+}
+
+// GetGroup 获取分组
+func (mgr *SessionManager) GetGroup(name string) (*Group, bool) {
+	mgr.groupsMu.RLock()
+	defer mgr.groupsMu.RUnlock()
+	g, ok := mgr.groups[name]
+	return g, ok
+}
+
+// JoinGroup 会话加入分组
+func (mgr *SessionManager) JoinGroup(name string, s *Session) error {
+	g, ok := mgr.GetGroup(name)
+	if !ok {
+		return ErrNoGroup
+	}
+	return g.Join(s)
+}
+
+// LeaveGroup 会话离开分组
+func (mgr *SessionManager) LeaveGroup(name string, s *Session) {
+	if g, ok := mgr.GetGroup(name); ok {
+		g.Leave(s)
+	}
+}
+
+// Broadcast 向分组广播消息，exclude 为不需要接收的 UserID
+func (mgr *SessionManager) Broadcast(name string, msg proto.Message, exclude ...uint64) error {
+	g, ok := mgr.GetGroup(name)
+	if !ok {
+		return ErrNoGroup
+	}
+	return g.Broadcast(msg, exclude...)
+}
+
+// Snapshot 返回当前所有有效会话的快照
+func (mgr *SessionManager) Snapshot() []*Session {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	sessions := make([]*Session, 0, mgr.count)
+	for _, list := range mgr.sessions {
+		sessions = append(sessions, list...)
+	}
+	return sessions
+}
+
+// Range 遍历所有有效会话，f 返回 false 时停止遍历；
+// 遍历的是调用时的快照，f 中可以安全地销毁会话
+func (mgr *SessionManager) Range(f func(*Session) bool) {
+	for _, s := range mgr.Snapshot() {
+		if !f(s) {
+			return
+		}
+	}
+}
+
+// BroadcastAll 向所有有效会话广播消息，消息只编码一次
+func (mgr *SessionManager) BroadcastAll(msg proto.Message) error {
+	return broadcast(mgr.Snapshot(), msg, nil)
+}
+
+// BroadcastFilter 向 filter 返回 true 的有效会话广播消息，消息只编码一次
+func (mgr *SessionManager) BroadcastFilter(msg proto.Message, filter func(*Session) bool) error {
+	return broadcast(mgr.Snapshot(), msg, filter)
+}
+
+// KickAll 以 reason 踢掉所有有效会话，msg 为可选的附带消息
+func (mgr *SessionManager) KickAll(reason KickReason, msg proto.Message) {
+	for _, s := range mgr.Snapshot() {
+		s.Kick(reason, msg)
+	}
+}
+
+// Close 关闭会话管理器，并以 KickReasonShutdown 踢掉所有会话
+func (mgr *SessionManager) Close() {
+	mgr.closeOnce.Do(func() {
+		close(mgr.closeChan)
+
+		mgr.mu.Lock()
+		sessions := make([]*Session, 0, mgr.count)
+		for _, list := range mgr.sessions {
+			sessions = append(sessions, list...)
+		}
+		mgr.sessions = make(map[uint64][]*Session)
+		mgr.count = 0
+		mgr.tokens = make(map[string]*Session)
+		mgr.mu.Unlock()
+
+		for _, s := range sessions {
+			s.Kick(KickReasonShutdown, nil)
+		}
+	})
 }
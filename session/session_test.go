@@ -0,0 +1,208 @@
+package session
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trainking/lulu/codec"
+	"github.com/trainking/lulu/logger"
+	"github.com/trainking/lulu/network"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testResumeOpCode = 65534
+	testKickOpCode   = 65535
+)
+
+// testCallback 记录断开和断线次数的会话回调
+type testCallback struct {
+	disconnects int32
+	detaches    int32
+}
+
+func (c *testCallback) OnConnect(*Session)                         {}
+func (c *testCallback) OnMessage(*Session, network.Packet)         {}
+func (c *testCallback) OnDisconnect(*Session)                      { atomic.AddInt32(&c.disconnects, 1) }
+func (c *testCallback) OnDetach(*Session)                          { atomic.AddInt32(&c.detaches, 1) }
+func (c *testCallback) GetMsgOpCode(proto.Message) (uint16, error) { return 0, nil }
+func (c *testCallback) GetMsgCodec(proto.Message) codec.Codec      { return codec.Proto }
+func (c *testCallback) GetKickOpCode() uint16                      { return testKickOpCode }
+func (c *testCallback) GetLogger() logger.Logger                   { return logger.Default() }
+
+// pipeConn 创建一对连接，返回服务端和客户端
+func pipeConn(t *testing.T) (network.Conn, network.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	config := &network.Config{PacketVersion: network.PacketV1}
+	s, _ := network.NewTcpConn(a, config)
+	c, _ := network.NewTcpConn(b, config)
+	return s, c
+}
+
+// readPacket 读取报文，超时后测试失败
+func readPacket(t *testing.T, c network.Conn) network.Packet {
+	t.Helper()
+	ch := make(chan network.Packet, 1)
+	go func() {
+		p, err := c.ReadPacket()
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- p
+	}()
+	select {
+	case p, ok := <-ch:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("read timeout")
+	}
+	return nil
+}
+
+// waitFor 等待 cond 成立，超时后测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// resumableSession 创建开启了恢复的会话并加入 mgr，返回会话、客户端连接和下发的令牌
+func resumableSession(t *testing.T, mgr *SessionManager, cb *testCallback) (*Session, network.Conn, string) {
+	t.Helper()
+	conn, client := pipeConn(t)
+	s := NewSession(conn, cb)
+	go s.Run()
+	s.SetUserID(10001)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.EnableResume(testResumeOpCode, time.Minute, 8) }()
+	p := readPacket(t, client)
+	if err := <-errc; err != nil {
+		t.Fatalf("EnableResume: %v", err)
+	}
+	if p.OpCode() != testResumeOpCode || string(p.Body()) != s.ResumeToken() {
+		t.Fatalf("got opcode %d token %q, want %q", p.OpCode(), p.Body(), s.ResumeToken())
+	}
+
+	mgr.Add(s)
+	waitFor(t, func() bool { return mgr.Len() == 1 })
+	return s, client, s.ResumeToken()
+}
+
+func TestSessionResumeDetached(t *testing.T) {
+	mgr := NewSessionManager()
+	// 先关闭所有连接，再关闭管理器，避免踢出时阻塞在没有读取的连接上
+	t.Cleanup(mgr.Close)
+	cb := &testCallback{}
+	s, client, token := resumableSession(t, mgr, cb)
+
+	// 客户端断线，会话进入等待恢复的状态，期间的消息被缓存
+	client.Close()
+	waitFor(t, s.IsDetached)
+	if n := atomic.LoadInt32(&cb.detaches); n != 1 {
+		t.Fatalf("got %d detaches, want 1", n)
+	}
+	if err := s.WritePacket(network.PackingOpcode(1, []byte("pending"))); err != nil {
+		t.Fatalf("WritePacket while detached: %v", err)
+	}
+
+	conn, newClient := pipeConn(t)
+	from := NewSession(conn, cb)
+	got := make(chan network.Packet, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			p, err := newClient.ReadPacket()
+			if err != nil {
+				break
+			}
+			got <- p
+		}
+		close(got)
+	}()
+
+	resumed, err := mgr.Resume(token, from)
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if resumed != s || s.IsDetached() {
+		t.Fatal("session not resumed")
+	}
+
+	// 先下发轮换后的令牌，再补发缓存的消息
+	p := <-got
+	if p == nil || p.OpCode() != testResumeOpCode || string(p.Body()) == token || string(p.Body()) != s.ResumeToken() {
+		t.Fatalf("got %v, want rotated token", p)
+	}
+	if p = <-got; p == nil || string(p.Body()) != "pending" {
+		t.Fatalf("got %v, want pending packet", p)
+	}
+
+	// 临时会话关闭，但不触发断开回调；旧令牌失效
+	select {
+	case <-from.Done():
+	default:
+		t.Fatal("temporary session not closed")
+	}
+	if n := atomic.LoadInt32(&cb.disconnects); n != 0 {
+		t.Fatalf("got %d disconnects, want 0", n)
+	}
+	if _, err := mgr.Resume(token, NewSession(conn, cb)); err != ErrResumeToken {
+		t.Fatalf("old token: got %v, want ErrResumeToken", err)
+	}
+}
+
+func TestSessionResumeTakeover(t *testing.T) {
+	mgr := NewSessionManager()
+	// 先关闭所有连接，再关闭管理器，避免踢出时阻塞在没有读取的连接上
+	t.Cleanup(mgr.Close)
+	cb := &testCallback{}
+	s, oldClient, token := resumableSession(t, mgr, cb)
+
+	// 旧连接还未检测到断开时恢复，旧连接收到 KickReasonResumed 后关闭
+	kick := make(chan network.Packet, 1)
+	go func() {
+		p, err := oldClient.ReadPacket()
+		if err == nil {
+			kick <- p
+		}
+		close(kick)
+	}()
+
+	conn, newClient := pipeConn(t)
+	go newClient.ReadPacket()
+	if _, err := mgr.Resume(token, NewSession(conn, cb)); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	select {
+	case p := <-kick:
+		if p == nil || p.OpCode() != testKickOpCode {
+			t.Fatalf("got %v, want kick packet", p)
+		}
+		reason, _, err := ParseKick(p.Body())
+		if err != nil || reason != KickReasonResumed {
+			t.Fatalf("got reason %d, %v, want KickReasonResumed", reason, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("old connection not kicked")
+	}
+	if s.IsDetached() {
+		t.Fatal("session detached after takeover")
+	}
+}
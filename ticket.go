@@ -0,0 +1,197 @@
+package lulu
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trainking/lulu/session"
+)
+
+// ticketSweepInterval 清理过期 nonce 的间隔
+const ticketSweepInterval = time.Minute
+
+// TicketKey 验证通过的票据在会话属性中的 key
+const TicketKey = "lulu.ticket"
+
+// TicketClaimDevice 票据中的设备标识，验证通过后设置为会话的设备
+const TicketClaimDevice = "device"
+
+type (
+	// Ticket 登录服签发的票据，格式为 base64url(JSON) + "." + base64url(HMAC-SHA256(base64url(JSON)))
+	Ticket struct {
+		UserID   uint64            `json:"uid"`              // 用户 ID
+		Expire   int64             `json:"exp"`              // 过期时间，Unix 秒
+		IssuedAt int64             `json:"iat,omitempty"`    // 签发时间，Unix 秒
+		Nonce    string            `json:"nonce"`            // 随机数，每张票据只能使用一次
+		Claims   map[string]string `json:"claims,omitempty"` // 业务自定义的声明
+	}
+
+	// TicketVerifier 票据校验器，校验签名、有效期，并通过 nonce 缓存防止重放
+	TicketVerifier struct {
+		secret    []byte
+		skew      time.Duration
+		nonces    map[string]int64 // 已使用的 nonce，value：可以清理的时间，Unix 秒
+		lastSweep time.Time
+		mu        sync.Mutex
+	}
+
+	// TicketFunc 从登录请求中取出票据
+	TicketFunc func(ctx Context) (string, error)
+
+	// ticketAuthenticator 使用票据验证的 Authenticator，登录被拒绝时释放票据的 nonce
+	ticketAuthenticator struct {
+		v      *TicketVerifier
+		ticket TicketFunc
+	}
+)
+
+// SignTicket 使用 secret 签发票据，用于登录服或测试
+func SignTicket(secret []byte, t *Ticket) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(ticketSign(secret, p)), nil
+}
+
+// ticketSign 计算票据的签名
+func ticketSign(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// NewTicketVerifier 创建票据校验器，skew 为允许的时钟偏差
+func NewTicketVerifier(secret []byte, skew time.Duration) (*TicketVerifier, error) {
+	if len(secret) == 0 {
+		return nil, ErrTicketSecret
+	}
+	return &TicketVerifier{
+		secret:    secret,
+		skew:      skew,
+		nonces:    make(map[string]int64),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Verify 校验票据，成功后票据的 nonce 被记录，同一票据再次校验返回 ErrTicketReplayed
+func (v *TicketVerifier) Verify(ticket string) (*Ticket, error) {
+	i := strings.IndexByte(ticket, '.')
+	if i < 0 {
+		return nil, ErrTicketInvalid
+	}
+	payload, sig := ticket[:i], ticket[i+1:]
+
+	sigB, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(sigB, ticketSign(v.secret, payload)) {
+		return nil, ErrTicketInvalid
+	}
+	payloadB, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrTicketInvalid
+	}
+	var t Ticket
+	if err := json.Unmarshal(payloadB, &t); err != nil {
+		return nil, errors.Wrapf(ErrTicketInvalid, "%v", err)
+	}
+	if t.UserID == 0 || t.Nonce == "" {
+		return nil, ErrTicketInvalid
+	}
+
+	now := time.Now()
+	skew := int64(v.skew / time.Second)
+	if now.Unix() > t.Expire+skew {
+		return nil, ErrTicketExpired
+	}
+	if t.IssuedAt > now.Unix()+skew {
+		return nil, errors.Wrap(ErrTicketInvalid, "issued in the future")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.lastSweep) >= ticketSweepInterval {
+		v.sweep(now.Unix())
+		v.lastSweep = now
+	}
+	if _, ok := v.nonces[t.Nonce]; ok {
+		return nil, ErrTicketReplayed
+	}
+	// 票据过期后无法通过校验，nonce 只需要保留到过期为止
+	v.nonces[t.Nonce] = t.Expire + skew
+	return &t, nil
+}
+
+// Release 释放已记录的 nonce，票据可以再次通过校验；用于校验通过后登录被拒绝的情况
+func (v *TicketVerifier) Release(nonce string) {
+	v.mu.Lock()
+	delete(v.nonces, nonce)
+	v.mu.Unlock()
+}
+
+// sweep 清理已过期票据的 nonce，需要持有锁调用
+func (v *TicketVerifier) sweep(now int64) {
+	for nonce, expire := range v.nonces {
+		if now > expire {
+			delete(v.nonces, nonce)
+		}
+	}
+}
+
+// Authenticator 返回使用票据验证的 Authenticator；ticket 从登录请求中取出票据。
+// 验证通过后票据保存在会话属性 TicketKey 中，声明了 TicketClaimDevice 时设置为会话的设备；
+// 重复登录策略拒绝登录时释放票据的 nonce，同一票据可以重试
+func (v *TicketVerifier) Authenticator(ticket TicketFunc) Authenticator {
+	return &ticketAuthenticator{v: v, ticket: ticket}
+}
+
+// Authenticate 验证登录请求中的票据
+func (a *ticketAuthenticator) Authenticate(ctx Context) (uint64, error) {
+	s, err := a.ticket(ctx)
+	if err != nil {
+		return 0, err
+	}
+	t, err := a.v.Verify(s)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx.Session().Set(TicketKey, t)
+	if device, ok := t.Claims[TicketClaimDevice]; ok {
+		ctx.Session().SetDevice(device)
+	}
+	return t.UserID, nil
+}
+
+// reject 登录被拒绝，释放票据的 nonce
+func (a *ticketAuthenticator) reject(ctx Context) {
+	if t, ok := GetTicket(ctx.Session()); ok {
+		ctx.Session().Delete(TicketKey)
+		a.v.Release(t.Nonce)
+	}
+}
+
+// TicketAuthenticator 使用配置的 TicketSecret 和 TicketSkew 创建票据验证；未配置 TicketSecret 时 panic
+func (app *App) TicketAuthenticator(ticket TicketFunc) Authenticator {
+	v, err := NewTicketVerifier([]byte(app.Config.TicketSecret), time.Duration(app.Config.TicketSkew)*time.Second)
+	if err != nil {
+		panic(err)
+	}
+	return v.Authenticator(ticket)
+}
+
+// GetTicket 获取会话验证通过的票据
+func GetTicket(s *session.Session) (*Ticket, bool) {
+	v, ok := s.Get(TicketKey)
+	if !ok {
+		return nil, false
+	}
+	t, ok := v.(*Ticket)
+	return t, ok
+}